@@ -22,6 +22,87 @@ CREATE TABLE IF NOT EXISTS users(
 	api_consumer_id UUID UNIQUE
 );
 
+ALTER TABLE users ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled_at TIMESTAMPTZ;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS provisioning_status TEXT NOT NULL DEFAULT 'pending'
+	CHECK (provisioning_status IN ('pending', 'active', 'failed'));
+UPDATE users SET provisioning_status='active' WHERE api_consumer_id IS NOT NULL AND provisioning_status='pending';
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMPTZ;
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_username_lower_key ON users (lower(username));
+DROP INDEX IF EXISTS users_email_lower_key;
+CREATE UNIQUE INDEX IF NOT EXISTS users_verified_email_lower_key ON users (lower(email)) WHERE email_verified_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS users_email_lower_idx ON users (lower(email));
+
+CREATE TABLE IF NOT EXISTS email_verification_tokens(
+	token_hash TEXT PRIMARY KEY,
+	user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	expires_at TIMESTAMPTZ NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+DROP TABLE IF EXISTS password_reset_tokens;
+
+CREATE TABLE IF NOT EXISTS session_revocation_tokens(
+	token_hash TEXT PRIMARY KEY,
+	user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	expires_at TIMESTAMPTZ NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS identities(
+	issuer TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	PRIMARY KEY (issuer, subject),
+	UNIQUE (user_id, issuer)
+);
+
+CREATE TABLE IF NOT EXISTS oidc_login_states(
+	state_hash TEXT PRIMARY KEY,
+	code_verifier TEXT NOT NULL,
+	nonce TEXT NOT NULL,
+	link_user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+	expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS user_roles(
+	user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	role TEXT NOT NULL CHECK (role IN ('user', 'support', 'admin')),
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	PRIMARY KEY (user_id, role)
+);
+
+INSERT INTO user_roles(user_id, role) SELECT id, 'user' FROM users
+	WHERE NOT EXISTS (SELECT 1 FROM user_roles WHERE user_roles.user_id=users.id);
+
+CREATE TABLE IF NOT EXISTS api_keys(
+	id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+	user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	name TEXT NOT NULL,
+	prefix TEXT NOT NULL,
+	key_hash TEXT NOT NULL UNIQUE,
+	scopes TEXT[] NOT NULL,
+	kong_credential_id UUID NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	revoked_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS api_keys_user_id_idx ON api_keys (user_id) WHERE revoked_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS login_attempts(
+	key TEXT PRIMARY KEY,
+	failures INTEGER NOT NULL DEFAULT 0,
+	lockouts INTEGER NOT NULL DEFAULT 0,
+	last_failure_at TIMESTAMPTZ NOT NULL,
+	locked_until TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS login_attempts_last_failure_at_idx ON login_attempts(last_failure_at);
+
 CREATE TABLE IF NOT EXISTS lists(
 	id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
 	name TEXT NOT NULL,
@@ -34,6 +115,77 @@ CREATE TABLE IF NOT EXISTS permissions(
 	type SMALLINT,
 	PRIMARY KEY (user_id, list_id)
 );
+
+CREATE TABLE IF NOT EXISTS organizations(
+	id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+	name TEXT NOT NULL,
+	member_permission SMALLINT NOT NULL DEFAULT 1,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS organization_members(
+	organization_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+	user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	role TEXT NOT NULL CHECK (role IN ('owner', 'admin', 'member')),
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	PRIMARY KEY (organization_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS organization_members_user_id_idx ON organization_members (user_id);
+
+CREATE TABLE IF NOT EXISTS organization_invitations(
+	id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+	organization_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+	invited_by UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	invitee_user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+	invitee_email TEXT,
+	role TEXT NOT NULL CHECK (role IN ('owner', 'admin', 'member')),
+	status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'accepted', 'declined')),
+	expires_at TIMESTAMPTZ NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	responded_at TIMESTAMPTZ,
+	CHECK (invitee_user_id IS NOT NULL OR invitee_email IS NOT NULL)
+);
+
+ALTER TABLE lists ADD COLUMN IF NOT EXISTS organization_id UUID REFERENCES organizations(id);
+
+CREATE TABLE IF NOT EXISTS list_invitations(
+	id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+	list_id UUID NOT NULL REFERENCES lists(id) ON DELETE CASCADE,
+	invited_by UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	invitee_user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+	invitee_email TEXT,
+	permission SMALLINT NOT NULL,
+	status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'accepted', 'declined')),
+	expires_at TIMESTAMPTZ NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	responded_at TIMESTAMPTZ,
+	CHECK (invitee_user_id IS NOT NULL OR invitee_email IS NOT NULL)
+);
+
+CREATE TABLE IF NOT EXISTS list_share_links(
+	id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+	list_id UUID NOT NULL REFERENCES lists(id) ON DELETE CASCADE,
+	token_hash TEXT NOT NULL UNIQUE,
+	permission SMALLINT NOT NULL,
+	created_by UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	expires_at TIMESTAMPTZ NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	revoked_at TIMESTAMPTZ
+);
+
+-- list_access resolves every way a user can reach a list: owning it, an
+-- explicit permission or being a member of the organization owning it.
+-- Readers take the highest type per user and list.
+CREATE OR REPLACE VIEW list_access AS
+	SELECT owner AS user_id, id AS list_id, 2::SMALLINT AS type FROM lists
+	UNION ALL
+	SELECT user_id, list_id, type FROM permissions
+	UNION ALL
+	SELECT m.user_id, l.id, CASE WHEN m.role IN ('owner', 'admin') THEN 2::SMALLINT ELSE o.member_permission END
+	FROM lists l
+	JOIN organizations o ON o.id=l.organization_id
+	JOIN organization_members m ON m.organization_id=o.id;
 `
 
 // CREATE TABLE IF NOT EXISTS todos(
@@ -71,7 +223,61 @@ func setupMainDatabase(dataSource, ddl string) error {
 	return nil
 }
 
+// anonymousConsumer is used by routes accepting more than one authentication
+// plugin, each of them falls back to it and the acl plugin rejects it.
+const anonymousConsumer = "anonymous"
+
+func setupAnonymousConsumer(address string) (string, error) {
+	res, err := http.Get(fmt.Sprintf("%s/consumers/%s", address, anonymousConsumer))
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch consumer %s: %v", anonymousConsumer, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		res, err = http.Post(fmt.Sprintf("%s/consumers", address), "application/json", bytes.NewBufferString(fmt.Sprintf(`{"username": "%s"}`, anonymousConsumer)))
+		if err != nil {
+			return "", fmt.Errorf("failed to create consumer %s: %v", anonymousConsumer, err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusCreated {
+			return "", fmt.Errorf("unexpected status code creating consumer %s: %v", anonymousConsumer, res.StatusCode)
+		}
+		log.Printf("kong: consumer created '%s'", anonymousConsumer)
+	} else if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status code fetching consumer %s: %v", anonymousConsumer, res.StatusCode)
+	}
+
+	consumer := struct {
+		ID string `json:"id"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&consumer); err != nil {
+		return "", fmt.Errorf("failed to decode consumer %s: %v", anonymousConsumer, err)
+	}
+
+	acl, err := http.Post(fmt.Sprintf("%s/consumers/%s/acls", address, consumer.ID), "application/json", bytes.NewBufferString(fmt.Sprintf(`{"group": "%s"}`, anonymousConsumer)))
+	if err != nil {
+		return "", fmt.Errorf("failed to add consumer %s to its acl group: %v", anonymousConsumer, err)
+	}
+	defer acl.Body.Close()
+	if acl.StatusCode != http.StatusCreated && acl.StatusCode != http.StatusConflict {
+		return "", fmt.Errorf("unexpected status code adding consumer %s to its acl group: %v", anonymousConsumer, acl.StatusCode)
+	}
+	return consumer.ID, nil
+}
+
 func setupKong(address string) error {
+	anonymousID, err := setupAnonymousConsumer(address)
+	if err != nil {
+		return err
+	}
+
+	type plugin struct {
+		Name    string                 `json:"name"`
+		RouteID string                 `json:"route_id"`
+		Config  map[string]interface{} `json:"config,omitempty"`
+	}
+
 	type route struct {
 		ID        string   `json:"id,omitempty"`
 		Methods   []string `json:"methods"`
@@ -80,6 +286,7 @@ func setupKong(address string) error {
 		Service   struct {
 			ID string `json:"id"`
 		} `json:"service"`
+		plugins []plugin
 	}
 
 	type service struct {
@@ -89,6 +296,17 @@ func setupKong(address string) error {
 		routes []route
 	}
 
+	// jwtOrAPIKey accepts requests authenticated by either plugin and rejects
+	// the anonymous consumer both fall back to.
+	jwtOrAPIKey := []plugin{
+		plugin{Name: "jwt", Config: map[string]interface{}{"anonymous": anonymousID}},
+		plugin{Name: "key-auth", Config: map[string]interface{}{"anonymous": anonymousID}},
+		plugin{
+			Name:   "acl",
+			Config: map[string]interface{}{"blacklist": []string{anonymousConsumer}},
+		},
+	}
+
 	services := []service{
 		service{
 			Name: "users",
@@ -100,11 +318,76 @@ func setupKong(address string) error {
 					Paths:     []string{"/users"},
 					StripPath: false,
 				},
+				route{
+					Methods:   []string{"GET"},
+					Paths:     []string{"/users"},
+					StripPath: false,
+				},
 				route{
 					Methods:   []string{"POST"},
 					Paths:     []string{"/login"},
 					StripPath: false,
 				},
+				route{
+					Methods:   []string{"POST"},
+					Paths:     []string{"/sessions"},
+					StripPath: false,
+				},
+				route{
+					Methods:   []string{"GET"},
+					Paths:     []string{"/oidc"},
+					StripPath: false,
+				},
+				route{
+					Methods:   []string{"GET"},
+					Paths:     []string{"/oidc/link"},
+					StripPath: false,
+					plugins: []plugin{
+						plugin{Name: "jwt"},
+					},
+				},
+				route{
+					Methods:   []string{"GET", "POST", "DELETE"},
+					Paths:     []string{"/users/me"},
+					StripPath: false,
+					plugins:   jwtOrAPIKey,
+				},
+				route{
+					Methods:   []string{"POST", "PUT", "DELETE"},
+					Paths:     []string{"/lists"},
+					StripPath: false,
+					plugins:   jwtOrAPIKey,
+				},
+				route{
+					Methods:   []string{"GET", "POST", "PATCH", "DELETE"},
+					Paths:     []string{"/orgs"},
+					StripPath: false,
+					plugins:   jwtOrAPIKey,
+				},
+				route{
+					Methods:   []string{"GET"},
+					Paths:     []string{"/admin"},
+					StripPath: false,
+					plugins: []plugin{
+						plugin{Name: "jwt"},
+						plugin{
+							Name:   "acl",
+							Config: map[string]interface{}{"whitelist": []string{todospoc.Config.AdminACLGroup, "support"}},
+						},
+					},
+				},
+				route{
+					Methods:   []string{"POST"},
+					Paths:     []string{"/admin"},
+					StripPath: false,
+					plugins: []plugin{
+						plugin{Name: "jwt"},
+						plugin{
+							Name:   "acl",
+							Config: map[string]interface{}{"whitelist": []string{todospoc.Config.AdminACLGroup}},
+						},
+					},
+				},
 			},
 		},
 	}
@@ -187,6 +470,29 @@ func setupKong(address string) error {
 					return fmt.Errorf("unexpected status code creating route for service %s: %v", svc.Host, req.StatusCode)
 				}
 				log.Printf("kong: route created %v %v (%s)\n", r.Methods, r.Paths, svc.Name)
+				routeBody := struct {
+					ID string `json:"id"`
+				}{}
+				if err := json.NewDecoder(req.Body).Decode(&routeBody); err != nil {
+					return fmt.Errorf("failed to decode response when creating route for service %s: %v", svc.Host, err)
+				}
+				// create route plugins
+				for _, p := range r.plugins {
+					p.RouteID = routeBody.ID
+					reqBody, err := json.Marshal(p)
+					if err != nil {
+						return fmt.Errorf("failed to encode plugin %s for service %s: %v", p.Name, svc.Host, err)
+					}
+					req, err := http.Post(fmt.Sprintf("%s/plugins", address), "application/json", bytes.NewBuffer(reqBody))
+					if err != nil {
+						return fmt.Errorf("failed to add plugin %s for service %s: %v", p.Name, svc.Host, err)
+					}
+					defer req.Body.Close()
+					if req.StatusCode != http.StatusCreated {
+						return fmt.Errorf("unexpected status code creating plugin %s for service %s: %v", p.Name, svc.Host, req.StatusCode)
+					}
+					log.Printf("kong: plugin created %s %v (%s)\n", p.Name, r.Paths, svc.Name)
+				}
 			}
 		}
 	}
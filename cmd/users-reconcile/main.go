@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+
+	"github.com/diorman/todospoc/logging"
+	"github.com/diorman/todospoc/wiring"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "report issues without repairing them")
+	flag.Parse()
+
+	logger, err := wiring.NewLogger("users-reconcile")
+	if err != nil {
+		logging.Default().Fatalf("%v", err)
+	}
+	deps, err := wiring.NewUsers()
+	if err != nil {
+		logger.Fatalf("%v", err)
+	}
+	defer deps.Close()
+
+	report, err := deps.NewReconciler(*dryRun).Run()
+	if err != nil {
+		logger.Fatalf("%v", err)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		logger.Fatalf("could not encode report: %v", err)
+	}
+
+	for _, issue := range report.Issues {
+		if !issue.Repaired {
+			os.Exit(2)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+
+	"github.com/diorman/todospoc"
+	"github.com/diorman/todospoc/logging"
+	"github.com/diorman/todospoc/utils"
+	"github.com/diorman/todospoc/wiring"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func main() {
+	logger, err := wiring.NewLogger("users-worker")
+	if err != nil {
+		logging.Default().Fatalf("%v", err)
+	}
+	deps, err := wiring.NewUsers()
+	if err != nil {
+		logger.Fatalf("%v", err)
+	}
+
+	var (
+		router  = httprouter.New()
+		checker = deps.NewChecker()
+		w       = deps.NewWorker()
+		rc      = deps.NewReconciler(false)
+	)
+	checker.Add("worker", w.CheckHeartbeat)
+	wiring.AddOperationalRoutes(router, checker)
+	go w.Start()
+	go rc.Start(todospoc.Config.ReconcileInterval)
+
+	// the HTTP server only exposes health checks and metrics, so there is
+	// nothing to drain before shutting it down.
+	srv := wiring.NewHTTPServer(todospoc.Config.WorkerHTTPAddress, router)
+	logger.Infof("starting users worker, serving operational endpoints on %s", srv.Addr)
+	err = utils.RunServer(srv, wiring.ShutdownTimeout, func() {
+		logger.Infof("stopping users worker")
+		checker.SetDraining()
+	})
+	if err != nil {
+		logger.Errorf("%v", err)
+	}
+
+	rc.Stop()
+	w.Stop()
+	if err := deps.Close(); err != nil {
+		logger.Errorf("could not close database: %v", err)
+	}
+	logger.Infof("users worker stopped")
+	if err != nil {
+		os.Exit(1)
+	}
+}
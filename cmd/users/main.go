@@ -1,35 +1,64 @@
 package main
 
 import (
-	"log"
-	"net/http"
+	"flag"
+	"os"
+	"time"
 
 	"github.com/diorman/todospoc"
+	"github.com/diorman/todospoc/logging"
 	"github.com/diorman/todospoc/users"
 	"github.com/diorman/todospoc/utils"
+	"github.com/diorman/todospoc/wiring"
 
 	"github.com/julienschmidt/httprouter"
-
-	_ "github.com/lib/pq"
 )
 
 func main() {
-	db, err := utils.CreateSQLDatabaseConnection(todospoc.Config.MainSQLDBSource)
+	withWorker := flag.Bool("with-worker", false, "process user events in this process instead of running users-worker")
+	flag.Parse()
+
+	logger, err := wiring.NewLogger("users")
 	if err != nil {
-		log.Fatalf("%v\n", err)
+		logging.Default().Fatalf("%v", err)
 	}
-	sqs, err := utils.NewSQSClient()
+	deps, err := wiring.NewUsers()
 	if err != nil {
-		log.Fatalf("%v\n", err)
+		logger.Fatalf("%v", err)
 	}
+
 	var (
-		router = httprouter.New()
-		store  = users.NewStore(db)
-		kong   = users.NewKongClient(todospoc.Config.KongAdminAddress)
-		h      = users.NewHandler(router, store, kong, sqs)
-		w      = users.NewWorker(sqs, store, kong, todospoc.Config.UserEventsQueueName)
+		router  = httprouter.New()
+		h       = users.NewHandler(router, deps.Store, deps.Kong, deps.SQS, deps.Throttle, deps.Mail, deps.IDP)
+		checker = deps.NewChecker()
+		w       *users.Worker
 	)
-	go w.Start()
-	log.Println("starting users service")
-	http.ListenAndServe(":8080", h)
+	if *withWorker {
+		w = deps.NewWorker()
+		checker.Add("worker", w.CheckHeartbeat)
+		go w.Start()
+	}
+	wiring.AddOperationalRoutes(router, checker)
+
+	srv := wiring.NewHTTPServer(todospoc.Config.UsersHTTPAddress, h)
+	logger.Infof("starting users service on %s", srv.Addr)
+	err = utils.RunServer(srv, wiring.ShutdownTimeout, func() {
+		logger.Infof("draining users service")
+		checker.SetDraining()
+		time.Sleep(wiring.DrainDelay)
+	})
+	if err != nil {
+		logger.Errorf("%v", err)
+	}
+
+	if w != nil {
+		w.Stop()
+	}
+	if err := deps.Close(); err != nil {
+		logger.Errorf("could not close database: %v", err)
+	}
+	logger.Infof("users service stopped")
+	if err != nil {
+		os.Exit(1)
+	}
 }
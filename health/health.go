@@ -0,0 +1,173 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/diorman/todospoc/utils"
+)
+
+const (
+	statusOK       = "ok"
+	statusFail     = "fail"
+	statusDraining = "draining"
+)
+
+type CheckFunc func(ctx context.Context) error
+
+type CheckResult struct {
+	Status     string  `json:"status"`
+	Error      string  `json:"error,omitempty"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+type Report struct {
+	Status    string                 `json:"status"`
+	CheckedAt time.Time              `json:"checked_at"`
+	Checks    map[string]CheckResult `json:"checks"`
+}
+
+// Checker runs the registered readiness checks concurrently, each bounded by
+// timeout, and serves the last report for ttl so that frequent probes don't
+// hammer the dependencies.
+type Checker struct {
+	timeout time.Duration
+	ttl     time.Duration
+
+	mu       sync.Mutex
+	names    []string
+	checks   map[string]CheckFunc
+	report   *Report
+	draining bool
+}
+
+func NewChecker(timeout, ttl time.Duration) *Checker {
+	return &Checker{
+		timeout: timeout,
+		ttl:     ttl,
+		checks:  map[string]CheckFunc{},
+	}
+}
+
+func (c *Checker) Add(name string, check CheckFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.names = append(c.names, name)
+	sort.Strings(c.names)
+	c.checks[name] = check
+	c.report = nil
+}
+
+// SetDraining makes every following check fail without running the
+// registered checks so that the instance is taken out of rotation.
+func (c *Checker) SetDraining() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.draining = true
+}
+
+func (c *Checker) Check(ctx context.Context) Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.draining {
+		return Report{Status: statusDraining, CheckedAt: time.Now(), Checks: map[string]CheckResult{}}
+	}
+	if c.report != nil && time.Since(c.report.CheckedAt) < c.ttl {
+		return *c.report
+	}
+
+	var (
+		wg      sync.WaitGroup
+		results = make([]CheckResult, len(c.names))
+	)
+	for i, name := range c.names {
+		wg.Add(1)
+		go func(i int, check CheckFunc) {
+			defer wg.Done()
+			results[i] = c.run(ctx, check)
+		}(i, c.checks[name])
+	}
+	wg.Wait()
+
+	report := Report{Status: statusOK, CheckedAt: time.Now(), Checks: map[string]CheckResult{}}
+	for i, name := range c.names {
+		report.Checks[name] = results[i]
+		if results[i].Status != statusOK {
+			report.Status = statusFail
+		}
+	}
+	c.report = &report
+	return report
+}
+
+func (c *Checker) run(ctx context.Context, check CheckFunc) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	var (
+		start = time.Now()
+		errc  = make(chan error, 1)
+		err   error
+	)
+	go func() {
+		errc <- check(ctx)
+	}()
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+		err = fmt.Errorf("check timed out after %v", c.timeout)
+	}
+
+	result := CheckResult{
+		Status:     statusOK,
+		DurationMS: float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	if err != nil {
+		result.Status = statusFail
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func (c *Checker) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := c.Check(r.Context())
+		code := http.StatusOK
+		if report.Status != statusOK {
+			code = http.StatusServiceUnavailable
+		}
+		utils.WriteJSON(w, code, report)
+	})
+}
+
+func LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		utils.WriteJSON(w, http.StatusOK, struct {
+			Status string `json:"status"`
+		}{statusOK})
+	})
+}
+
+// HTTPCheck succeeds when a GET to url answers with a 2xx status.
+func HTTPCheck(url string) CheckFunc {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return err
+		}
+		res, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			return fmt.Errorf("unexpected status code: %d", res.StatusCode)
+		}
+		return nil
+	}
+}
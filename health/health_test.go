@@ -0,0 +1,90 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadinessHandler(t *testing.T) {
+	tests := map[string]struct {
+		checks     map[string]CheckFunc
+		statusCode int
+		failing    []string
+	}{
+		"returns 200 when all checks pass": {
+			checks: map[string]CheckFunc{
+				"database": func(context.Context) error { return nil },
+				"kong":     func(context.Context) error { return nil },
+			},
+			statusCode: http.StatusOK,
+		},
+		"returns 503 when a check fails": {
+			checks: map[string]CheckFunc{
+				"database": func(context.Context) error { return nil },
+				"kong":     func(context.Context) error { return errors.New("connection refused") },
+			},
+			statusCode: http.StatusServiceUnavailable,
+			failing:    []string{"kong"},
+		},
+		"returns 503 when a check times out": {
+			checks: map[string]CheckFunc{
+				"sqs": func(context.Context) error { time.Sleep(time.Second); return nil },
+			},
+			statusCode: http.StatusServiceUnavailable,
+			failing:    []string{"sqs"},
+		},
+	}
+
+	for td, tt := range tests {
+		c := NewChecker(50*time.Millisecond, time.Minute)
+		for name, check := range tt.checks {
+			c.Add(name, check)
+		}
+
+		r, _ := http.NewRequest("GET", "/readyz", nil)
+		w := httptest.NewRecorder()
+		c.ReadinessHandler().ServeHTTP(w, r)
+
+		if tt.statusCode != w.Code {
+			t.Errorf("%v: handler returned wrong status code: expected %v, got %v", td, tt.statusCode, w.Code)
+		}
+		for _, name := range tt.failing {
+			if !strings.Contains(w.Body.String(), `"`+name+`":{"status":"fail"`) {
+				t.Errorf("%v: expected %v to fail, got %v", td, name, w.Body.String())
+			}
+		}
+	}
+}
+
+func TestCheckerCachesReport(t *testing.T) {
+	calls := 0
+	c := NewChecker(time.Second, time.Minute)
+	c.Add("database", func(context.Context) error {
+		calls++
+		return nil
+	})
+
+	c.Check(context.Background())
+	c.Check(context.Background())
+
+	if calls != 1 {
+		t.Errorf("expected check to run once, ran %d times", calls)
+	}
+}
+
+func TestCheckerDraining(t *testing.T) {
+	c := NewChecker(time.Second, time.Minute)
+	c.Add("database", func(context.Context) error { return nil })
+	c.Check(context.Background())
+
+	c.SetDraining()
+
+	if report := c.Check(context.Background()); report.Status != statusDraining {
+		t.Errorf("unexpected status: %v", report.Status)
+	}
+}
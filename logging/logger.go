@@ -0,0 +1,157 @@
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+var levelNames = map[Level]string{
+	DebugLevel: "debug",
+	InfoLevel:  "info",
+	WarnLevel:  "warn",
+	ErrorLevel: "error",
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+	for level, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return level, nil
+		}
+	}
+	return InfoLevel, fmt.Errorf("unknown log level: %q", s)
+}
+
+type Fields map[string]interface{}
+
+// Logger writes one JSON object per line. Loggers derived with With share
+// the output and lock of their parent.
+type Logger struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	level  Level
+	fields Fields
+}
+
+func New(out io.Writer, level Level) *Logger {
+	return &Logger{
+		mu:     &sync.Mutex{},
+		out:    out,
+		level:  level,
+		fields: Fields{},
+	}
+}
+
+var defaultLogger = New(os.Stderr, InfoLevel)
+
+func Default() *Logger {
+	return defaultLogger
+}
+
+func SetDefault(l *Logger) {
+	defaultLogger = l
+}
+
+func (l *Logger) With(fields Fields) *Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{mu: l.mu, out: l.out, level: l.level, fields: merged}
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.log(DebugLevel, format, args...)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.log(InfoLevel, format, args...)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.log(WarnLevel, format, args...)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.log(ErrorLevel, format, args...)
+}
+
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.log(ErrorLevel, format, args...)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level Level, format string, args ...interface{}) {
+	if level < l.level {
+		return
+	}
+
+	entry := make(Fields, len(l.fields)+3)
+	for k, v := range l.fields {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		entry[k] = v
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry["msg"] = fmt.Sprintf(format, args...)
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line = []byte(fmt.Sprintf(`{"level":"error","msg":"could not encode log entry: %v"}`, err))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(append(line, '\n'))
+}
+
+type contextKey int
+
+const (
+	loggerKey contextKey = iota
+	requestIDKey
+)
+
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, l)
+}
+
+func FromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(loggerKey).(*Logger); ok {
+		return l
+	}
+	return Default()
+}
+
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	ctx = context.WithValue(ctx, requestIDKey, requestID)
+	return NewContext(ctx, FromContext(ctx).With(Fields{"request_id": requestID}))
+}
+
+func RequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey).(string)
+	return requestID
+}
@@ -0,0 +1,85 @@
+package logging
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	RequestIDHeader     = "X-Request-ID"
+	KongRequestIDHeader = "Kong-Request-ID"
+	maxRequestIDLength  = 128
+)
+
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// Middleware assigns every request an id, taken from X-Request-ID or
+// Kong-Request-ID when present, stores it with a request scoped logger in the
+// request context and writes an access log line once the request completes.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		requestID := r.Header.Get(RequestIDHeader)
+		if !isValidRequestID(requestID) {
+			requestID = r.Header.Get(KongRequestIDHeader)
+		}
+		if !isValidRequestID(requestID) {
+			requestID = NewRequestID()
+		}
+		w.Header().Set(RequestIDHeader, requestID)
+
+		ctx := WithRequestID(r.Context(), requestID)
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		FromContext(ctx).With(Fields{
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"status":      rec.status,
+			"bytes":       rec.bytes,
+			"duration_ms": float64(time.Since(start)) / float64(time.Millisecond),
+			"remote_addr": r.RemoteAddr,
+			"user_agent":  r.UserAgent(),
+		}).Infof("%s %s %d", r.Method, r.URL.Path, rec.status)
+	})
+}
+
+func NewRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func isValidRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range requestID {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,66 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	tests := map[string]struct {
+		headers   map[string]string
+		requestID string
+	}{
+		"honours X-Request-ID": {
+			headers:   map[string]string{RequestIDHeader: "abc-123", KongRequestIDHeader: "kong-456"},
+			requestID: "abc-123",
+		},
+		"falls back to Kong-Request-ID": {
+			headers:   map[string]string{KongRequestIDHeader: "kong-456"},
+			requestID: "kong-456",
+		},
+		"replaces invalid request ids": {
+			headers: map[string]string{RequestIDHeader: "bad id\n"},
+		},
+		"generates request id when missing": {},
+	}
+
+	defer SetDefault(Default())
+
+	for td, tt := range tests {
+		var (
+			out           bytes.Buffer
+			seenRequestID string
+		)
+		SetDefault(New(&out, InfoLevel))
+
+		h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seenRequestID = RequestID(r.Context())
+			w.WriteHeader(http.StatusTeapot)
+		}))
+		r, _ := http.NewRequest("GET", "/path", nil)
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if seenRequestID == "" || (tt.requestID != "" && seenRequestID != tt.requestID) {
+			t.Errorf("%v: unexpected request id in context: %q", td, seenRequestID)
+		}
+		if header := w.Header().Get(RequestIDHeader); header != seenRequestID {
+			t.Errorf("%v: unexpected response request id: expected %q, got %q", td, seenRequestID, header)
+		}
+
+		entry := Fields{}
+		if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+			t.Errorf("%v: could not decode access log: %v", td, err)
+			continue
+		}
+		if entry["request_id"] != seenRequestID || entry["status"] != float64(http.StatusTeapot) || entry["path"] != "/path" {
+			t.Errorf("%v: unexpected access log: %v", td, entry)
+		}
+	}
+}
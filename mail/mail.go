@@ -0,0 +1,78 @@
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"time"
+
+	"github.com/diorman/todospoc/logging"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Sender interface {
+	Send(msg Message) error
+}
+
+type smtpSender struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// NewSMTPSender sends plain text messages through the SMTP server at addr.
+// Authentication is skipped when username is empty.
+func NewSMTPSender(addr, from, username, password string) Sender {
+	s := &smtpSender{addr: addr, from: from}
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		s.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return s
+}
+
+func (s *smtpSender) Send(msg Message) error {
+	if err := smtp.SendMail(s.addr, s.auth, s.from, []string{msg.To}, format(s.from, msg, time.Now())); err != nil {
+		return fmt.Errorf("could not send email to %s: %v", msg.To, err)
+	}
+	return nil
+}
+
+func format(from string, msg Message, date time.Time) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(msg.Body)
+	return b.Bytes()
+}
+
+type logSender struct {
+	logger *logging.Logger
+}
+
+// NewLogSender writes messages to the log instead of delivering them, it
+// stands in for SMTP when running locally.
+func NewLogSender(logger *logging.Logger) Sender {
+	return &logSender{logger}
+}
+
+func (s *logSender) Send(msg Message) error {
+	s.logger.With(logging.Fields{
+		"to":      msg.To,
+		"subject": msg.Subject,
+		"body":    msg.Body,
+	}).Infof("email not delivered, no SMTP server configured")
+	return nil
+}
@@ -0,0 +1,41 @@
+package mail
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diorman/todospoc/logging"
+)
+
+func TestFormat(t *testing.T) {
+	var (
+		date     = time.Date(2018, 5, 1, 0, 0, 0, 0, time.UTC)
+		msg      = Message{To: "user@example.com", Subject: "Verify your email", Body: "token: 123"}
+		expected = "From: no-reply@example.com\r\n" +
+			"To: user@example.com\r\n" +
+			"Subject: Verify your email\r\n" +
+			"Date: Tue, 01 May 2018 00:00:00 +0000\r\n" +
+			"MIME-Version: 1.0\r\n" +
+			"Content-Type: text/plain; charset=utf-8\r\n" +
+			"\r\n" +
+			"token: 123"
+	)
+
+	if got := string(format("no-reply@example.com", msg, date)); got != expected {
+		t.Errorf("wrong message: expected %q, got %q", expected, got)
+	}
+}
+
+func TestLogSender(t *testing.T) {
+	var out bytes.Buffer
+	s := NewLogSender(logging.New(&out, logging.InfoLevel))
+
+	if err := s.Send(Message{To: "user@example.com", Subject: "Hi", Body: "token: 123"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(out.String(), `"to":"user@example.com"`) || !strings.Contains(out.String(), `"body":"token: 123"`) {
+		t.Errorf("message was not logged: %v", out.String())
+	}
+}
@@ -0,0 +1,36 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// InstrumentHandle records the duration of every request served by handle.
+// route must be the pattern the handle is registered with so that path
+// parameters don't explode the label cardinality.
+func InstrumentHandle(method, route string, handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handle(rec, r, ps)
+		HTTPRequestDuration.WithLabelValues(method, route, strconv.Itoa(rec.status)).Observe(time.Since(start).Seconds())
+	}
+}
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
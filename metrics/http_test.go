@@ -0,0 +1,35 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestInstrumentHandle(t *testing.T) {
+	router := httprouter.New()
+	router.GET("/things/:id", InstrumentHandle("GET", "/things/:id", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+
+	for _, path := range []string{"/things/1", "/things/2"} {
+		r, _ := http.NewRequest("GET", path, nil)
+		router.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	observer, err := HTTPRequestDuration.GetMetricWithLabelValues("GET", "/things/:id", "404")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	m := &dto.Metric{}
+	if err := observer.(prometheus.Histogram).Write(m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if count := m.GetHistogram().GetSampleCount(); count != 2 {
+		t.Errorf("unexpected sample count: expected 2, got %d", count)
+	}
+}
@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "todospoc"
+
+var (
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of HTTP requests by route and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	LoginFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "users",
+		Name:      "login_failures_total",
+		Help:      "Failed login attempts by reason.",
+	}, []string{"reason"})
+
+	LoginLockouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "users",
+		Name:      "login_lockouts_total",
+		Help:      "Lockouts caused by too many failed logins, by key type.",
+	}, []string{"key_type"})
+
+	SyncProvisioning = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "users",
+		Name:      "sync_provisioning_total",
+		Help:      "Inline provisioning attempts on signup, by result.",
+	}, []string{"result"})
+
+	WorkerMessagesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "worker",
+		Name:      "messages_received_total",
+		Help:      "Messages received from the queue.",
+	}, []string{"queue"})
+
+	WorkerMessagesProcessed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "worker",
+		Name:      "messages_processed_total",
+		Help:      "Messages processed and deleted from the queue.",
+	}, []string{"queue", "event_type"})
+
+	WorkerMessagesFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "worker",
+		Name:      "messages_failed_total",
+		Help:      "Messages that could not be processed, by processing stage.",
+	}, []string{"queue", "stage"})
+
+	WorkerProcessingDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "worker",
+		Name:      "message_processing_duration_seconds",
+		Help:      "Time spent processing a single message.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"queue"})
+
+	ReconcilerIssues = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "reconciler",
+		Name:      "issues",
+		Help:      "Issues found between users and Kong consumers by the last reconciliation.",
+	}, []string{"kind"})
+
+	KongRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "kong",
+		Name:      "admin_request_duration_seconds",
+		Help:      "Duration of Kong Admin API calls by operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	KongRequestErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "kong",
+		Name:      "admin_request_errors_total",
+		Help:      "Failed Kong Admin API calls by operation.",
+	}, []string{"operation"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		HTTPRequestDuration,
+		LoginFailures,
+		LoginLockouts,
+		SyncProvisioning,
+		WorkerMessagesReceived,
+		WorkerMessagesProcessed,
+		WorkerMessagesFailed,
+		WorkerProcessingDuration,
+		ReconcilerIssues,
+		KongRequestDuration,
+		KongRequestErrors,
+	)
+}
@@ -0,0 +1,339 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clockSkew is the leeway allowed when checking the expiry of ID tokens.
+const clockSkew = time.Minute
+
+type IDToken struct {
+	Issuer            string
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	PreferredUsername string
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider is an OpenID Connect relying party for a single issuer using the
+// authorization code flow with PKCE. The discovery document and signing keys
+// are fetched on first use.
+type Provider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	client       *http.Client
+
+	mu        sync.Mutex
+	discovery *discovery
+	keys      map[string]*rsa.PublicKey
+}
+
+func NewProvider(issuer, clientID, clientSecret, redirectURL string) *Provider {
+	return &Provider{
+		issuer:       issuer,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		redirectURL:  redirectURL,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *Provider) Issuer() string {
+	return p.issuer
+}
+
+// NewPKCE returns a code verifier and its S256 code challenge.
+func NewPKCE() (string, string, error) {
+	verifier, err := RandomString()
+	if err != nil {
+		return "", "", err
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// RandomString returns 32 random bytes encoded for use in URLs.
+func RandomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("could not generate random string: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (p *Provider) AuthCodeURL(state, nonce, codeChallenge string) (string, error) {
+	d, err := p.getDiscovery()
+	if err != nil {
+		return "", err
+	}
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.clientID},
+		"redirect_uri":          {p.redirectURL},
+		"scope":                 {"openid email profile"},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {codeChallenge},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + params.Encode(), nil
+}
+
+// Exchange redeems an authorization code and returns the raw ID token.
+func (p *Provider) Exchange(code, codeVerifier string) (string, error) {
+	d, err := p.getDiscovery()
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURL},
+		"client_id":     {p.clientID},
+		"code_verifier": {codeVerifier},
+	}
+	if p.clientSecret != "" {
+		form.Set("client_secret", p.clientSecret)
+	}
+
+	r, err := p.client.PostForm(d.TokenEndpoint, form)
+	if err != nil {
+		return "", fmt.Errorf("could not exchange authorization code: %v", err)
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected response exchanging authorization code: %d", r.StatusCode)
+	}
+
+	response := struct {
+		IDToken string `json:"id_token"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&response); err != nil {
+		return "", fmt.Errorf("could not decode token response: %v", err)
+	}
+	if response.IDToken == "" {
+		return "", errors.New("token response has no id_token")
+	}
+	return response.IDToken, nil
+}
+
+// Verify checks the signature of an RS256 ID token against the provider's
+// JWKS along with its issuer, audience, expiry and nonce.
+func (p *Provider) Verify(rawIDToken, nonce string) (*IDToken, error) {
+	parts := strings.Split(rawIDToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed id token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed id token header: %v", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported id token algorithm: %q", header.Alg)
+	}
+
+	key, err := p.getKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed id token signature: %v", err)
+	}
+	hashed := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], sig); err != nil {
+		return nil, errors.New("invalid id token signature")
+	}
+
+	var claims struct {
+		Issuer            string          `json:"iss"`
+		Subject           string          `json:"sub"`
+		Audience          json.RawMessage `json:"aud"`
+		Expiry            int64           `json:"exp"`
+		Nonce             string          `json:"nonce"`
+		Email             string          `json:"email"`
+		EmailVerified     bool            `json:"email_verified"`
+		PreferredUsername string          `json:"preferred_username"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed id token claims: %v", err)
+	}
+
+	switch {
+	case claims.Issuer != p.issuer:
+		return nil, fmt.Errorf("unexpected id token issuer: %q", claims.Issuer)
+	case !hasAudience(claims.Audience, p.clientID):
+		return nil, errors.New("id token was not issued for this client")
+	case time.Now().Add(-clockSkew).After(time.Unix(claims.Expiry, 0)):
+		return nil, errors.New("id token has expired")
+	case claims.Nonce != nonce:
+		return nil, errors.New("id token nonce does not match")
+	case claims.Subject == "":
+		return nil, errors.New("id token has no subject")
+	}
+
+	return &IDToken{
+		Issuer:            claims.Issuer,
+		Subject:           claims.Subject,
+		Email:             claims.Email,
+		EmailVerified:     claims.EmailVerified,
+		PreferredUsername: claims.PreferredUsername,
+	}, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// hasAudience accepts both forms of the aud claim, a string or a list.
+func hasAudience(raw json.RawMessage, clientID string) bool {
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		return single == clientID
+	}
+	var list []string
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return false
+	}
+	for _, aud := range list {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Provider) getDiscovery() (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	r, err := p.client.Get(strings.TrimRight(p.issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch OIDC discovery document: %v", err)
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response fetching OIDC discovery document: %d", r.StatusCode)
+	}
+
+	d := &discovery{}
+	if err := json.NewDecoder(r.Body).Decode(d); err != nil {
+		return nil, fmt.Errorf("could not decode OIDC discovery document: %v", err)
+	}
+	if d.Issuer != p.issuer {
+		return nil, fmt.Errorf("OIDC discovery document is for issuer %q", d.Issuer)
+	}
+	p.discovery = d
+	return d, nil
+}
+
+// getKey refreshes the cached JWKS once when kid is unknown so that key
+// rotations on the provider are picked up.
+func (p *Provider) getKey(kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	d, err := p.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := p.fetchKeys(d.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown id token signing key: %q", kid)
+}
+
+func (p *Provider) fetchKeys(jwksURI string) (map[string]*rsa.PublicKey, error) {
+	r, err := p.client.Get(jwksURI)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch JWKS: %v", err)
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response fetching JWKS: %d", r.StatusCode)
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&jwks); err != nil {
+		return nil, fmt.Errorf("could not decode JWKS: %v", err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,115 @@
+package oidc
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/diorman/todospoc/oidc/oidctest"
+)
+
+// authorize follows the authorization URL and returns the code the stand-in
+// provider redirects back with.
+func authorize(t *testing.T, authURL string) string {
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	r, err := client.Get(authURL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r.Body.Close()
+	redirect, err := url.Parse(r.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return redirect.Query().Get("code")
+}
+
+func TestProviderFlow(t *testing.T) {
+	for _, trailingSlash := range []bool{false, true} {
+		testProviderFlow(t, trailingSlash)
+	}
+}
+
+// testProviderFlow signs in with the stand-in provider, its issuer ending in
+// a slash when trailingSlash is set as some providers' do.
+func testProviderFlow(t *testing.T, trailingSlash bool) {
+	server := oidctest.NewServer("todospoc")
+	defer server.Close()
+	if trailingSlash {
+		server.SetIssuer(server.URL + "/")
+	}
+	p := NewProvider(server.Issuer(), "todospoc", "", "http://localhost/oidc/callback")
+
+	verifier, challenge, err := NewPKCE()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	authURL, err := p.AuthCodeURL("state", "nonce", challenge)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	code := authorize(t, authURL)
+
+	if _, err := p.Exchange(code, "wrong-verifier"); err == nil {
+		t.Errorf("expected exchange to fail with the wrong code verifier")
+	}
+
+	code = authorize(t, authURL)
+	rawIDToken, err := p.Exchange(code, verifier)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	token, err := p.Verify(rawIDToken, "nonce")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if token.Issuer != server.Issuer() || token.Subject != "oidctest-user" || !token.EmailVerified {
+		t.Errorf("unexpected id token: %+v", token)
+	}
+}
+
+func TestProviderVerify(t *testing.T) {
+	server := oidctest.NewServer("todospoc")
+	defer server.Close()
+	p := NewProvider(server.Issuer(), "todospoc", "", "http://localhost/oidc/callback")
+
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":   server.Issuer(),
+			"sub":   "123",
+			"aud":   []string{"other", "todospoc"},
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nonce": "nonce",
+		}
+		for k, v := range overrides {
+			c[k] = v
+		}
+		return c
+	}
+
+	tests := map[string]struct {
+		token string
+		valid bool
+	}{
+		"accepts a valid token":             {server.SignIDToken(claims(nil)), true},
+		"rejects another issuer":            {server.SignIDToken(claims(map[string]interface{}{"iss": "https://evil.example.com"})), false},
+		"rejects another audience":          {server.SignIDToken(claims(map[string]interface{}{"aud": "other"})), false},
+		"rejects an expired token":          {server.SignIDToken(claims(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()})), false},
+		"rejects a different nonce":         {server.SignIDToken(claims(map[string]interface{}{"nonce": "other"})), false},
+		"rejects a tampered signature":      {server.SignIDToken(claims(nil)) + "x", false},
+		"rejects a token that is not a jwt": {"not-a-jwt", false},
+	}
+
+	for td, tt := range tests {
+		_, err := p.Verify(tt.token, "nonce")
+		if tt.valid && err != nil {
+			t.Errorf("%v: unexpected error: %v", td, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("%v: expected verification error", td)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package users
+
+import (
+	"database/sql"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diorman/todospoc"
+	"github.com/diorman/todospoc/logging"
+	"github.com/diorman/todospoc/metrics"
+	"github.com/diorman/todospoc/utils"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// consumerGroupsHeader is set by the Kong ACL plugin with the groups of
+	// the authenticated consumer.
+	consumerGroupsHeader = "X-Consumer-Groups"
+
+	defaultAdminPageSize = 50
+	maxAdminPageSize     = 200
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+type adminUserResponse struct {
+	ID              string     `json:"id"`
+	Username        string     `json:"username"`
+	Status          string     `json:"status"`
+	ConsumerID      *string    `json:"api_consumer_id"`
+	Email           *string    `json:"email"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	CreatedAt       time.Time  `json:"created_at"`
+	DisabledAt      *time.Time `json:"disabled_at"`
+	Roles           []string   `json:"roles"`
+}
+
+func newAdminUserResponse(u user) adminUserResponse {
+	res := adminUserResponse{
+		ID:        u.ID,
+		Username:  u.Username,
+		Status:    u.status(),
+		CreatedAt: u.CreatedAt,
+		Roles:     append([]string{}, u.Roles...),
+	}
+	if u.ConsumerID.Valid {
+		res.ConsumerID = &u.ConsumerID.String
+	}
+	if u.Email.Valid {
+		res.Email = &u.Email.String
+	}
+	if u.EmailVerifiedAt.Valid {
+		res.EmailVerifiedAt = &u.EmailVerifiedAt.Time
+	}
+	if u.DisabledAt.Valid {
+		res.DisabledAt = &u.DisabledAt.Time
+	}
+	return res
+}
+
+// requireRole rejects requests from consumers outside of the ACL groups of
+// roles. Kong enforces the same rule, this guards against requests that
+// bypass it.
+func requireRole(roles []string, handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		for _, group := range strings.Split(r.Header.Get(consumerGroupsHeader), ",") {
+			for _, role := range roles {
+				if strings.TrimSpace(group) == aclGroup(role) {
+					handle(w, r, ps)
+					return
+				}
+			}
+		}
+		utils.WriteProblem(w, r, utils.NewProblem(http.StatusForbidden, "forbidden", "admin access required"))
+	}
+}
+
+// withUser loads the user referenced by the :id route parameter.
+func (h Handler) withUser(handle func(http.ResponseWriter, *http.Request, user)) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		userID := ps.ByName("id")
+		if !uuidPattern.MatchString(userID) {
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusNotFound, "user_not_found", ""))
+			return
+		}
+		u, err := h.store.getUser(userID)
+		if err == sql.ErrNoRows {
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusNotFound, "user_not_found", ""))
+			return
+		}
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+		handle(w, r, u)
+	}
+}
+
+func (h Handler) handleAdminListUsers() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		var (
+			query  = r.URL.Query()
+			filter = userFilter{
+				UsernamePrefix: query.Get("username"),
+				Status:         query.Get("status"),
+				After:          query.Get("after"),
+				Limit:          defaultAdminPageSize,
+			}
+			fieldErrors utils.ValidationError
+		)
+
+		switch filter.Status {
+		case "", userStatusPending, userStatusActive, userStatusFailed, userStatusDisabled:
+		default:
+			fieldErrors = append(fieldErrors, utils.FieldError{Field: "status", Message: "must be one of pending, active, failed or disabled"})
+		}
+		if limit := query.Get("limit"); limit != "" {
+			n, err := strconv.Atoi(limit)
+			if err != nil || n < 1 || n > maxAdminPageSize {
+				fieldErrors = append(fieldErrors, utils.FieldError{Field: "limit", Message: "must be a number between 1 and " + strconv.Itoa(maxAdminPageSize)})
+			}
+			filter.Limit = n
+		}
+		if len(fieldErrors) > 0 {
+			utils.WriteProblem(w, r, fieldErrors)
+			return
+		}
+
+		users, err := h.store.listUsers(filter)
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+
+		response := struct {
+			Users []adminUserResponse `json:"users"`
+			Next  string              `json:"next,omitempty"`
+		}{Users: []adminUserResponse{}}
+		for _, u := range users {
+			response.Users = append(response.Users, newAdminUserResponse(u))
+		}
+		if len(users) == filter.Limit {
+			response.Next = users[len(users)-1].Username
+		}
+
+		utils.WriteJSON(w, http.StatusOK, response)
+	}
+}
+
+func (h Handler) handleAdminGetUser() httprouter.Handle {
+	return h.withUser(func(w http.ResponseWriter, r *http.Request, u user) {
+		response := struct {
+			adminUserResponse
+			Kong struct {
+				Consumer       *KongConsumer `json:"consumer"`
+				JWTCredentials int           `json:"jwt_credentials"`
+			} `json:"kong"`
+		}{adminUserResponse: newAdminUserResponse(u)}
+
+		if u.ConsumerID.Valid {
+			consumer, err := h.kong.getConsumer(u.ConsumerID.String)
+			if err != nil {
+				writeKongProblem(w, r, err)
+				return
+			}
+			response.Kong.Consumer = consumer
+		}
+		if response.Kong.Consumer != nil {
+			credentials, err := h.kong.getJWTCredentials(u.ConsumerID.String)
+			if err != nil {
+				writeKongProblem(w, r, err)
+				return
+			}
+			response.Kong.JWTCredentials = len(credentials)
+		}
+
+		utils.WriteJSON(w, http.StatusOK, response)
+	})
+}
+
+// handleAdminDisableUser blocks logins and revokes the JWT credentials and API
+// keys so that they stop being accepted by Kong.
+func (h Handler) handleAdminDisableUser() httprouter.Handle {
+	return h.withUser(func(w http.ResponseWriter, r *http.Request, u user) {
+		if err := h.store.setDisabled(u.ID, true); err != nil {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+		if u.ConsumerID.Valid {
+			if err := h.kong.deleteJWTCredentials(u.ConsumerID.String); err != nil {
+				writeKongProblem(w, r, err)
+				return
+			}
+			if err := h.kong.deleteKeyAuthCredentials(u.ConsumerID.String); err != nil {
+				writeKongProblem(w, r, err)
+				return
+			}
+		}
+		if err := h.store.revokeAPIKeys(u.ID); err != nil {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+		h.writeAdminUser(w, r, u.ID)
+	})
+}
+
+func (h Handler) handleAdminEnableUser() httprouter.Handle {
+	return h.withUser(func(w http.ResponseWriter, r *http.Request, u user) {
+		if u.ConsumerID.Valid {
+			credentials, err := h.kong.getJWTCredentials(u.ConsumerID.String)
+			if err != nil {
+				writeKongProblem(w, r, err)
+				return
+			}
+			if len(credentials) == 0 {
+				if err := h.kong.createJWTCredentials(u.ConsumerID.String); err != nil {
+					writeKongProblem(w, r, err)
+					return
+				}
+			}
+		}
+		if err := h.store.setDisabled(u.ID, false); err != nil {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+		h.writeAdminUser(w, r, u.ID)
+	})
+}
+
+// handleAdminReprovisionUser drops the user's Kong consumer and publishes a
+// new user_created event so the worker provisions it from scratch.
+func (h Handler) handleAdminReprovisionUser() httprouter.Handle {
+	return h.withUser(func(w http.ResponseWriter, r *http.Request, u user) {
+		if u.ConsumerID.Valid {
+			if err := h.kong.deleteConsumer(u.ConsumerID.String); err != nil {
+				writeKongProblem(w, r, err)
+				return
+			}
+			if err := h.store.clearConsumerID(u.ID); err != nil {
+				logging.FromContext(r.Context()).Errorf("%v", err)
+				utils.WriteProblem(w, r, err)
+				return
+			}
+			// the key-auth credentials went away with the consumer
+			if err := h.store.revokeAPIKeys(u.ID); err != nil {
+				logging.FromContext(r.Context()).Errorf("%v", err)
+				utils.WriteProblem(w, r, err)
+				return
+			}
+		}
+
+		e, err := newEvent(userCreatedEvent, logging.RequestID(r.Context()), userCreatedPayload{UserID: u.ID})
+		if err == nil {
+			err = h.sqs.SendMessage(todospoc.Config.UserEventsQueueName, e)
+		}
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+
+		u.ConsumerID = sql.NullString{}
+		u.ProvisioningStatus = userStatusPending
+		utils.WriteJSON(w, http.StatusAccepted, newAdminUserResponse(u))
+	})
+}
+
+func (h Handler) writeAdminUser(w http.ResponseWriter, r *http.Request, userID string) {
+	u, err := h.store.getUser(userID)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("%v", err)
+		utils.WriteProblem(w, r, err)
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, newAdminUserResponse(u))
+}
+
+func writeKongProblem(w http.ResponseWriter, r *http.Request, err error) {
+	logging.FromContext(r.Context()).Errorf("%v", err)
+	utils.WriteProblem(w, r, utils.NewProblem(http.StatusBadGateway, "kong_unavailable", "could not reach the API gateway"))
+}
+
+func (h Handler) setupAdminRoutes() {
+	var (
+		readers = []string{roleAdmin, roleSupport}
+		writers = []string{roleAdmin}
+	)
+	routes := []struct {
+		method string
+		path   string
+		roles  []string
+		handle httprouter.Handle
+	}{
+		{"GET", "/admin/users", readers, h.handleAdminListUsers()},
+		{"GET", "/admin/users/:id", readers, h.handleAdminGetUser()},
+		{"POST", "/admin/users/:id/disable", writers, h.handleAdminDisableUser()},
+		{"POST", "/admin/users/:id/enable", writers, h.handleAdminEnableUser()},
+		{"POST", "/admin/users/:id/reprovision", writers, h.handleAdminReprovisionUser()},
+		{"POST", "/admin/users/:id/roles", writers, h.handleAdminSetRoles()},
+	}
+	for _, route := range routes {
+		h.Handle(route.method, route.path, metrics.InstrumentHandle(route.method, route.path, requireRole(route.roles, route.handle)))
+	}
+}
@@ -0,0 +1,147 @@
+package users
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestAdminRoutes(t *testing.T) {
+	tests := map[string]struct {
+		method       string
+		path         string
+		groups       string
+		statusCode   int
+		responseBody string
+		storeUsers   []user
+	}{
+		"returns 403 when consumer is not an admin": {
+			method:       "GET",
+			path:         "/admin/users",
+			groups:       "users",
+			statusCode:   http.StatusForbidden,
+			responseBody: `{"type":"about:blank","title":"Forbidden","status":403,"detail":"admin access required","instance":"/admin/users","code":"forbidden"}`,
+		},
+		"returns 200 and users when listing": {
+			method:       "GET",
+			path:         "/admin/users?status=active",
+			groups:       "users, admin",
+			statusCode:   http.StatusOK,
+			responseBody: `{"users":[{"id":"8c4a1b4e-0a3c-4b8f-9a51-0d5c1f3f6a11","username":"user-123","status":"active","api_consumer_id":"123","email":null,"email_verified_at":null,"created_at":"2018-05-01T00:00:00Z","disabled_at":null,"roles":["user"]}]}`,
+			storeUsers:   []user{testUser},
+		},
+		"returns 200 and users when listing as support": {
+			method:       "GET",
+			path:         "/admin/users",
+			groups:       "user, support",
+			statusCode:   http.StatusOK,
+			responseBody: `{"users":[{"id":"8c4a1b4e-0a3c-4b8f-9a51-0d5c1f3f6a11","username":"user-123","status":"active","api_consumer_id":"123","email":null,"email_verified_at":null,"created_at":"2018-05-01T00:00:00Z","disabled_at":null,"roles":["user"]}]}`,
+			storeUsers:   []user{testUser},
+		},
+		"returns 403 when support disables a user": {
+			method:       "POST",
+			path:         "/admin/users/" + testUser.ID + "/disable",
+			groups:       "support",
+			statusCode:   http.StatusForbidden,
+			responseBody: `{"type":"about:blank","title":"Forbidden","status":403,"detail":"admin access required","instance":"/admin/users/8c4a1b4e-0a3c-4b8f-9a51-0d5c1f3f6a11/disable","code":"forbidden"}`,
+		},
+		"returns 400 when listing with an invalid filter": {
+			method:       "GET",
+			path:         "/admin/users?status=unknown",
+			groups:       "admin",
+			statusCode:   http.StatusBadRequest,
+			responseBody: `{"type":"about:blank","title":"Bad Request","status":400,"detail":"request has invalid fields","instance":"/admin/users","code":"validation_failed","errors":[{"field":"status","message":"must be one of pending, active, failed or disabled"}]}`,
+		},
+		"returns 404 when user id is not a uuid": {
+			method:       "GET",
+			path:         "/admin/users/123",
+			groups:       "admin",
+			statusCode:   http.StatusNotFound,
+			responseBody: `{"type":"about:blank","title":"Not Found","status":404,"instance":"/admin/users/123","code":"user_not_found"}`,
+		},
+		"returns 200 and kong status with user detail": {
+			method:       "GET",
+			path:         "/admin/users/" + testUser.ID,
+			groups:       "admin",
+			statusCode:   http.StatusOK,
+			responseBody: `{"id":"8c4a1b4e-0a3c-4b8f-9a51-0d5c1f3f6a11","username":"user-123","status":"active","api_consumer_id":"123","email":null,"email_verified_at":null,"created_at":"2018-05-01T00:00:00Z","disabled_at":null,"roles":["user"],"kong":{"consumer":{"id":"123","custom_id":"8c4a1b4e-0a3c-4b8f-9a51-0d5c1f3f6a11","created_at":1525132800000},"jwt_credentials":1}}`,
+		},
+	}
+
+	for td, tt := range tests {
+		s := testStore{}
+		s.getUserReturn.user = testUser
+		s.listUsersReturn.users = tt.storeUsers
+
+		k := testKongClient{}
+		k.getConsumerReturn.consumer = &KongConsumer{ID: "123", CustomID: testUser.ID, CreatedAt: 1525132800000}
+		k.getJWTCredentialsReturn.jwtCredentials = []JWTCredentials{testJWTCredentials}
+
+		h := NewHandler(httprouter.New(), &s, &k, &testSQSClient{}, &testLoginThrottle{}, &testMailer{}, nil)
+		r, _ := http.NewRequest(tt.method, tt.path, nil)
+		r.Header.Set(consumerGroupsHeader, tt.groups)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if tt.statusCode != w.Code {
+			t.Errorf("%v: handler returned wrong status code: expected %v, got %v", td, tt.statusCode, w.Code)
+		}
+
+		if tt.responseBody != w.Body.String() {
+			t.Errorf("%v: handler returned wrong body: expected %v, got %v", td, tt.responseBody, w.Body.String())
+		}
+	}
+}
+
+func TestAdminDisableUser(t *testing.T) {
+	s := testStore{}
+	s.getUserReturn.user = testUser
+	k := testKongClient{}
+
+	h := NewHandler(httprouter.New(), &s, &k, &testSQSClient{}, &testLoginThrottle{}, &testMailer{}, nil)
+	r, _ := http.NewRequest("POST", "/admin/users/"+testUser.ID+"/disable", nil)
+	r.Header.Set(consumerGroupsHeader, "admin")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: expected %v, got %v", http.StatusOK, w.Code)
+	}
+	if len(s.setDisabledCalls) != 1 || !s.setDisabledCalls[0] {
+		t.Errorf("expected user to be disabled, got %v", s.setDisabledCalls)
+	}
+	if len(k.deletedJWTCredentials) != 1 || k.deletedJWTCredentials[0] != testUser.ConsumerID.String {
+		t.Errorf("expected jwt credentials to be deleted, got %v", k.deletedJWTCredentials)
+	}
+	if len(s.revokedUserAPIKeys) != 1 || s.revokedUserAPIKeys[0] != testUser.ID {
+		t.Errorf("expected api keys to be revoked, got %v", s.revokedUserAPIKeys)
+	}
+}
+
+func TestAdminReprovisionUser(t *testing.T) {
+	s := testStore{}
+	s.getUserReturn.user = testUser
+	k := testKongClient{}
+	sqsClient := testSQSClient{}
+
+	h := NewHandler(httprouter.New(), &s, &k, &sqsClient, &testLoginThrottle{}, &testMailer{}, nil)
+	r, _ := http.NewRequest("POST", "/admin/users/"+testUser.ID+"/reprovision", nil)
+	r.Header.Set(consumerGroupsHeader, "admin")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if w.Code != http.StatusAccepted {
+		t.Errorf("handler returned wrong status code: expected %v, got %v", http.StatusAccepted, w.Code)
+	}
+	if len(k.deletedConsumers) != 1 || k.deletedConsumers[0] != testUser.ConsumerID.String {
+		t.Errorf("expected the consumer to be deleted, got %v", k.deletedConsumers)
+	}
+	if len(s.revokedUserAPIKeys) != 1 || s.revokedUserAPIKeys[0] != testUser.ID {
+		t.Errorf("expected api keys to be revoked, got %v", s.revokedUserAPIKeys)
+	}
+	if len(sqsClient.sentMessages) != 1 {
+		t.Errorf("expected a user_created event, got %v", len(sqsClient.sentMessages))
+	}
+}
@@ -0,0 +1,258 @@
+package users
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/diorman/todospoc/logging"
+	"github.com/diorman/todospoc/utils"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	apiKeyPrefix        = "tdp_"
+	apiKeyNameMaxLength = 64
+	maxAPIKeysPerUser   = 25
+)
+
+// apiKeyScopes are the scopes that can be delegated to API keys, a key only
+// gets the ones the roles of its user grant.
+var apiKeyScopes = map[string]bool{
+	listsReadScope:  true,
+	listsWriteScope: true,
+	orgsReadScope:   true,
+	orgsWriteScope:  true,
+	"todos:read":    true,
+	"todos:write":   true,
+}
+
+type apiKey struct {
+	ID               string
+	UserID           string
+	Name             string
+	Prefix           string
+	Scopes           []string
+	KongCredentialID string
+	CreatedAt        time.Time
+}
+
+type apiKeyResponse struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Prefix    string    `json:"prefix"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newAPIKeyResponse(k apiKey) apiKeyResponse {
+	return apiKeyResponse{ID: k.ID, Name: k.Name, Prefix: k.Prefix, Scopes: k.Scopes, CreatedAt: k.CreatedAt}
+}
+
+// withSignedInUser loads the consumer authenticated by Kong, either with a JWT
+// or an API key, for routes under /users/me.
+func (h Handler) withSignedInUser(handle func(http.ResponseWriter, *http.Request, httprouter.Params, user)) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		userID := r.Header.Get(consumerCustomIDHeader)
+		if !uuidPattern.MatchString(userID) {
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusUnauthorized, "unauthenticated", "a signed in user is required"))
+			return
+		}
+		u, err := h.store.getUser(userID)
+		if err == sql.ErrNoRows {
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusUnauthorized, "unauthenticated", "a signed in user is required"))
+			return
+		}
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+		if u.DisabledAt.Valid {
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusForbidden, "account_disabled", "account is disabled"))
+			return
+		}
+		handle(w, r, ps, u)
+	}
+}
+
+func validateAPIKey(name string, scopes, granted []string) error {
+	var fieldErrors utils.ValidationError
+	switch length := utf8.RuneCountInString(name); {
+	case length == 0:
+		fieldErrors = append(fieldErrors, utils.FieldError{Field: "name", Message: "name can't be empty"})
+	case length > apiKeyNameMaxLength:
+		fieldErrors = append(fieldErrors, utils.FieldError{Field: "name", Message: fmt.Sprintf("name must be at most %d characters long", apiKeyNameMaxLength)})
+	}
+	if len(scopes) == 0 {
+		fieldErrors = append(fieldErrors, utils.FieldError{Field: "scopes", Message: "at least one scope is required"})
+	}
+	for _, scope := range scopes {
+		switch {
+		case !apiKeyScopes[scope]:
+			fieldErrors = append(fieldErrors, utils.FieldError{Field: "scopes", Message: fmt.Sprintf("unknown scope %q", scope)})
+		case !containsString(granted, scope):
+			fieldErrors = append(fieldErrors, utils.FieldError{Field: "scopes", Message: fmt.Sprintf("scope %q is not granted to the user", scope)})
+		}
+	}
+	if len(fieldErrors) > 0 {
+		return fieldErrors
+	}
+	return nil
+}
+
+// handleCreateAPIKey returns the key in the response only, it is stored
+// hashed and Kong keeps it as a key-auth credential of the user's consumer.
+func (h Handler) handleCreateAPIKey() httprouter.Handle {
+	return h.requireScope(apiKeysManageScope, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params, u user) {
+		requestBody := struct {
+			Name   string   `json:"name"`
+			Scopes []string `json:"scopes"`
+		}{}
+
+		if err := utils.DecodeJSON(w, r, &requestBody); err != nil {
+			utils.WriteProblem(w, r, err)
+			return
+		}
+		name := strings.TrimSpace(requestBody.Name)
+		scopes := uniqueSorted(requestBody.Scopes)
+		if err := validateAPIKey(name, scopes, scopesForRoles(u.Roles)); err != nil {
+			utils.WriteProblem(w, r, err)
+			return
+		}
+
+		if !u.ConsumerID.Valid {
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusConflict, "provisioning_pending", "account is still being provisioned, try again later"))
+			return
+		}
+
+		keys, err := h.store.listAPIKeys(u.ID)
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+		if len(keys) >= maxAPIKeysPerUser {
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusConflict, "too_many_api_keys", fmt.Sprintf("at most %d API keys are allowed, revoke one first", maxAPIKeysPerUser)))
+			return
+		}
+
+		secret, err := randomToken()
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+		key := apiKeyPrefix + secret
+
+		credentialID, err := h.kong.createKeyAuthCredentials(u.ConsumerID.String, key)
+		if err != nil {
+			writeKongProblem(w, r, err)
+			return
+		}
+
+		k, err := h.store.saveAPIKey(apiKey{
+			UserID:           u.ID,
+			Name:             name,
+			Prefix:           key[:len(apiKeyPrefix)+6],
+			Scopes:           scopes,
+			KongCredentialID: credentialID,
+		}, hashToken(key))
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			if err := h.kong.deleteKeyAuthCredential(u.ConsumerID.String, credentialID); err != nil {
+				logging.FromContext(r.Context()).Errorf("could not remove key-auth credential %s: %v", credentialID, err)
+			}
+			utils.WriteProblem(w, r, err)
+			return
+		}
+
+		response := struct {
+			apiKeyResponse
+			Key string `json:"key"`
+		}{newAPIKeyResponse(k), key}
+
+		utils.WriteJSON(w, http.StatusCreated, response)
+	})
+}
+
+func (h Handler) handleListAPIKeys() httprouter.Handle {
+	return h.requireScope(apiKeysManageScope, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params, u user) {
+		keys, err := h.store.listAPIKeys(u.ID)
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+
+		response := struct {
+			APIKeys []apiKeyResponse `json:"api_keys"`
+		}{[]apiKeyResponse{}}
+		for _, k := range keys {
+			response.APIKeys = append(response.APIKeys, newAPIKeyResponse(k))
+		}
+
+		utils.WriteJSON(w, http.StatusOK, response)
+	})
+}
+
+func (h Handler) handleRevokeAPIKey() httprouter.Handle {
+	return h.requireScope(apiKeysManageScope, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params, u user) {
+		keyID := ps.ByName("keyID")
+		if !uuidPattern.MatchString(keyID) {
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusNotFound, "api_key_not_found", ""))
+			return
+		}
+		k, err := h.store.getAPIKey(u.ID, keyID)
+		if err == sql.ErrNoRows {
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusNotFound, "api_key_not_found", ""))
+			return
+		}
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+
+		if u.ConsumerID.Valid {
+			if err := h.kong.deleteKeyAuthCredential(u.ConsumerID.String, k.KongCredentialID); err != nil {
+				writeKongProblem(w, r, err)
+				return
+			}
+		}
+		if err := h.store.revokeAPIKey(k.ID); err != nil {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func uniqueSorted(values []string) []string {
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
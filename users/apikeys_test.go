@@ -0,0 +1,207 @@
+package users
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+var testAPIKey = apiKey{
+	ID:               "5f0e7d4c-3b2a-4c19-8e07-6d5c4b3a2f10",
+	UserID:           testUser.ID,
+	Name:             "ci",
+	Prefix:           "tdp_abcdef",
+	Scopes:           []string{"todos:read"},
+	KongCredentialID: "e2b7c1f0-6a4d-4d3e-9c8b-1a0f9e8d7c6b",
+	CreatedAt:        testUser.CreatedAt,
+}
+
+func TestCreateAPIKey(t *testing.T) {
+	tests := map[string]struct {
+		requestBody    string
+		signedInUserID string
+		storeUser      user
+		storeUserErr   error
+		statusCode     int
+		responseBody   string
+		createdKeys    int
+	}{
+		"returns 201 and the key": {
+			requestBody:    `{"name":"ci","scopes":["todos:read","todos:read"]}`,
+			signedInUserID: testUser.ID,
+			storeUser:      testUser,
+			statusCode:     http.StatusCreated,
+			createdKeys:    1,
+		},
+		"returns 400 when the name and scopes are invalid": {
+			requestBody:    `{"name":" ","scopes":["admin"]}`,
+			signedInUserID: testUser.ID,
+			storeUser:      testUser,
+			statusCode:     http.StatusBadRequest,
+			responseBody:   `{"type":"about:blank","title":"Bad Request","status":400,"detail":"request has invalid fields","instance":"/users/me/api-keys","code":"validation_failed","errors":[{"field":"name","message":"name can't be empty"},{"field":"scopes","message":"unknown scope \"admin\""}]}`,
+		},
+		"returns 401 without a signed in user": {
+			requestBody:  `{"name":"ci","scopes":["todos:read"]}`,
+			statusCode:   http.StatusUnauthorized,
+			responseBody: `{"type":"about:blank","title":"Unauthorized","status":401,"detail":"a signed in user is required","instance":"/users/me/api-keys","code":"unauthenticated"}`,
+		},
+		"returns 401 when the signed in user does not exist": {
+			requestBody:    `{"name":"ci","scopes":["todos:read"]}`,
+			signedInUserID: testUser.ID,
+			storeUserErr:   sql.ErrNoRows,
+			statusCode:     http.StatusUnauthorized,
+			responseBody:   `{"type":"about:blank","title":"Unauthorized","status":401,"detail":"a signed in user is required","instance":"/users/me/api-keys","code":"unauthenticated"}`,
+		},
+		"returns 403 for a disabled user": {
+			requestBody:    `{"name":"ci","scopes":["todos:read"]}`,
+			signedInUserID: testUser.ID,
+			storeUser:      testDisabledUser,
+			statusCode:     http.StatusForbidden,
+			responseBody:   `{"type":"about:blank","title":"Forbidden","status":403,"detail":"account is disabled","instance":"/users/me/api-keys","code":"account_disabled"}`,
+		},
+		"returns 409 while the user is being provisioned": {
+			requestBody:    `{"name":"ci","scopes":["todos:read"]}`,
+			signedInUserID: testUser.ID,
+			storeUser:      testPendingUser,
+			statusCode:     http.StatusConflict,
+			responseBody:   `{"type":"about:blank","title":"Conflict","status":409,"detail":"account is still being provisioned, try again later","instance":"/users/me/api-keys","code":"provisioning_pending"}`,
+		},
+	}
+
+	for td, tt := range tests {
+		s := testStore{}
+		s.getUserReturn.user = tt.storeUser
+		s.getUserReturn.err = tt.storeUserErr
+		s.saveAPIKeyReturn.apiKey = testAPIKey
+		k := testKongClient{}
+		k.createKeyAuthCredentialsReturn.credentialID = testAPIKey.KongCredentialID
+
+		h := NewHandler(httprouter.New(), &s, &k, &testSQSClient{}, &testLoginThrottle{}, &testMailer{}, nil)
+		r, _ := http.NewRequest("POST", "/users/me/api-keys", bytes.NewBufferString(tt.requestBody))
+		if tt.signedInUserID != "" {
+			r.Header.Set(consumerCustomIDHeader, tt.signedInUserID)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if tt.statusCode != w.Code {
+			t.Errorf("%v: handler returned wrong status code: expected %v, got %v", td, tt.statusCode, w.Code)
+		}
+
+		if tt.responseBody != "" && tt.responseBody != w.Body.String() {
+			t.Errorf("%v: handler returned wrong body: expected %v, got %v", td, tt.responseBody, w.Body.String())
+		}
+
+		if len(k.createdKeys) != tt.createdKeys {
+			t.Errorf("%v: wrong number of created keys: expected %v, got %v", td, tt.createdKeys, len(k.createdKeys))
+			continue
+		}
+
+		if tt.createdKeys > 0 {
+			response := struct {
+				ID  string `json:"id"`
+				Key string `json:"key"`
+			}{}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatalf("%v: unexpected error: %v", td, err)
+			}
+			if response.Key != k.createdKeys[0] || !strings.HasPrefix(response.Key, apiKeyPrefix) {
+				t.Errorf("%v: handler returned wrong key: expected %v, got %v", td, k.createdKeys[0], response.Key)
+			}
+			if s.savedAPIKeyHashes[0] != hashToken(response.Key) {
+				t.Errorf("%v: expected the key to be stored hashed", td)
+			}
+		}
+	}
+}
+
+func TestCreateAPIKeyRemovesCredentialWhenSaveFails(t *testing.T) {
+	s := testStore{}
+	s.getUserReturn.user = testUser
+	s.saveAPIKeyReturn.err = fmt.Errorf("boom")
+	k := testKongClient{}
+	k.createKeyAuthCredentialsReturn.credentialID = testAPIKey.KongCredentialID
+
+	h := NewHandler(httprouter.New(), &s, &k, &testSQSClient{}, &testLoginThrottle{}, &testMailer{}, nil)
+	r, _ := http.NewRequest("POST", "/users/me/api-keys", bytes.NewBufferString(`{"name":"ci","scopes":["todos:read"]}`))
+	r.Header.Set(consumerCustomIDHeader, testUser.ID)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("handler returned wrong status code: expected %v, got %v", http.StatusInternalServerError, w.Code)
+	}
+	if len(k.deletedKeyAuthCredentials) != 1 || k.deletedKeyAuthCredentials[0] != testAPIKey.KongCredentialID {
+		t.Errorf("expected key-auth credential to be removed, got %v", k.deletedKeyAuthCredentials)
+	}
+}
+
+func TestListAPIKeys(t *testing.T) {
+	s := testStore{}
+	s.getUserReturn.user = testUser
+	s.listAPIKeysReturn.apiKeys = []apiKey{testAPIKey}
+
+	h := NewHandler(httprouter.New(), &s, &testKongClient{}, &testSQSClient{}, &testLoginThrottle{}, &testMailer{}, nil)
+	r, _ := http.NewRequest("GET", "/users/me/api-keys", nil)
+	r.Header.Set(consumerCustomIDHeader, testUser.ID)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	expected := fmt.Sprintf(`{"api_keys":[{"id":"%v","name":"ci","prefix":"tdp_abcdef","scopes":["todos:read"],"created_at":"2018-05-01T00:00:00Z"}]}`, testAPIKey.ID)
+	if w.Code != http.StatusOK || w.Body.String() != expected {
+		t.Errorf("unexpected response: %v %v", w.Code, w.Body.String())
+	}
+}
+
+func TestRevokeAPIKey(t *testing.T) {
+	tests := map[string]struct {
+		keyID          string
+		storeAPIKeyErr error
+		statusCode     int
+		revokedKeys    int
+	}{
+		"returns 204 and revokes the key": {
+			keyID:       testAPIKey.ID,
+			statusCode:  http.StatusNoContent,
+			revokedKeys: 1,
+		},
+		"returns 404 for an unknown key": {
+			keyID:          testAPIKey.ID,
+			storeAPIKeyErr: sql.ErrNoRows,
+			statusCode:     http.StatusNotFound,
+		},
+		"returns 404 for a malformed key id": {
+			keyID:      "abc",
+			statusCode: http.StatusNotFound,
+		},
+	}
+
+	for td, tt := range tests {
+		s := testStore{}
+		s.getUserReturn.user = testUser
+		s.getAPIKeyReturn.apiKey = testAPIKey
+		s.getAPIKeyReturn.err = tt.storeAPIKeyErr
+		k := testKongClient{}
+
+		h := NewHandler(httprouter.New(), &s, &k, &testSQSClient{}, &testLoginThrottle{}, &testMailer{}, nil)
+		r, _ := http.NewRequest("DELETE", "/users/me/api-keys/"+tt.keyID, nil)
+		r.Header.Set(consumerCustomIDHeader, testUser.ID)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if tt.statusCode != w.Code {
+			t.Errorf("%v: handler returned wrong status code: expected %v, got %v", td, tt.statusCode, w.Code)
+		}
+
+		if len(s.revokedAPIKeys) != tt.revokedKeys || len(k.deletedKeyAuthCredentials) != tt.revokedKeys {
+			t.Errorf("%v: wrong number of revoked keys: expected %v, got %v", td, tt.revokedKeys, len(s.revokedAPIKeys))
+		}
+	}
+}
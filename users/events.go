@@ -0,0 +1,73 @@
+package users
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	userCreatedEvent   = "user_created"
+	userLockedOutEvent = "user_locked_out"
+
+	organizationInvitationCreatedEvent = "organization_invitation_created"
+	listInvitationCreatedEvent         = "list_invitation_created"
+	listSharedEvent                    = "list_shared"
+)
+
+// event is the envelope of every message published to the user events queue.
+// RequestID carries the id of the HTTP request that caused the event so the
+// worker can log with the same correlation id.
+type event struct {
+	EventType string          `json:"event_type"`
+	RequestID string          `json:"request_id,omitempty"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+type userCreatedPayload struct {
+	UserID string `json:"user_id"`
+}
+
+// userLockedOutPayload identifies the username or client IP that reached the
+// failed login limit.
+type userLockedOutPayload struct {
+	KeyType     string    `json:"key_type"`
+	Key         string    `json:"key"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+// organizationInvitationCreatedPayload lets subscribers notify the invitee,
+// either InviteeUserID or InviteeEmail is set.
+type organizationInvitationCreatedPayload struct {
+	InvitationID   string `json:"invitation_id"`
+	OrganizationID string `json:"organization_id"`
+	InviteeUserID  string `json:"invitee_user_id,omitempty"`
+	InviteeEmail   string `json:"invitee_email,omitempty"`
+}
+
+// listInvitationCreatedPayload lets subscribers notify the invitee, either
+// InviteeUserID or InviteeEmail is set.
+type listInvitationCreatedPayload struct {
+	InvitationID  string `json:"invitation_id"`
+	ListID        string `json:"list_id"`
+	InviteeUserID string `json:"invitee_user_id,omitempty"`
+	InviteeEmail  string `json:"invitee_email,omitempty"`
+	Permission    string `json:"permission"`
+}
+
+// listSharedPayload is published when a user joins a list through a share
+// link.
+type listSharedPayload struct {
+	ListID      string `json:"list_id"`
+	UserID      string `json:"user_id"`
+	Permission  string `json:"permission"`
+	ShareLinkID string `json:"share_link_id"`
+}
+
+func newEvent(eventType, requestID string, payload interface{}) (event, error) {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return event{}, fmt.Errorf("could not encode %s event payload: %v", eventType, err)
+	}
+	return event{EventType: eventType, RequestID: requestID, Payload: payloadBytes}, nil
+}
@@ -6,32 +6,51 @@ import (
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"log"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/diorman/todospoc"
+	"github.com/diorman/todospoc/logging"
+	"github.com/diorman/todospoc/mail"
+	"github.com/diorman/todospoc/metrics"
 
 	"github.com/diorman/todospoc/utils"
 	"github.com/julienschmidt/httprouter"
 	"github.com/lib/pq"
 )
 
+// provisioningRetryAfter is the number of seconds clients are asked to wait
+// before retrying while a user is being provisioned.
+const provisioningRetryAfter = 5
+
+const meRoutesPrefix = "/users/me"
+
 type Handler struct {
 	*httprouter.Router
-	store Store
-	kong  KongClient
-	sqs   utils.SQSClient
+	me       *httprouter.Router
+	store    Store
+	kong     KongClient
+	sqs      utils.SQSClient
+	throttle LoginThrottle
+	mailer   mail.Sender
+	idp      IdentityProvider
 }
 
-func NewHandler(r *httprouter.Router, s Store, k KongClient, sqs utils.SQSClient) Handler {
+// NewHandler leaves the OpenID Connect routes out when idp is nil.
+func NewHandler(r *httprouter.Router, s Store, k KongClient, sqs utils.SQSClient, t LoginThrottle, m mail.Sender, idp IdentityProvider) Handler {
 	h := Handler{
-		Router: r,
-		store:  s,
-		kong:   k,
-		sqs:    sqs,
+		Router:   r,
+		me:       httprouter.New(),
+		store:    s,
+		kong:     k,
+		sqs:      sqs,
+		throttle: t,
+		mailer:   m,
+		idp:      idp,
 	}
 	h.setupRoutes()
 	return h
@@ -41,53 +60,76 @@ func (h Handler) handleCreateUser() httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		var (
 			username    string
-			decoder     = json.NewDecoder(r.Body)
+			email       sql.NullString
 			requestBody = struct {
 				Username string `json:"username"`
+				Email    string `json:"email"`
 			}{}
+			fieldErrors utils.ValidationError
 		)
 
-		if err := decoder.Decode(&requestBody); err != nil {
-			log.Println(err)
-			utils.WriteStandardErrorJSON(w, http.StatusInternalServerError)
+		if err := utils.DecodeJSON(w, r, &requestBody); err != nil {
+			utils.WriteProblem(w, r, err)
 			return
 		}
 
-		if username = strings.TrimSpace(requestBody.Username); username == "" {
-			utils.WriteJSON(w, http.StatusBadRequest, errors.New("username can't be empty"))
+		username = normalizeUsername(requestBody.Username)
+		if err := validateUsername(username); err != nil {
+			fieldErrors = append(fieldErrors, err.(utils.ValidationError)...)
+		}
+		if e := normalizeEmail(requestBody.Email); e != "" {
+			if err := validateEmail(e); err != nil {
+				fieldErrors = append(fieldErrors, err.(utils.ValidationError)...)
+			}
+			email = sql.NullString{String: e, Valid: true}
+		}
+		if len(fieldErrors) > 0 {
+			utils.WriteProblem(w, r, fieldErrors)
 			return
 		}
 
-		userID, err := h.store.saveUser(username, func(userID string) error {
-			messageBody := struct {
-				EventType string `json:"event_type"`
-				Payload   struct {
-					UserID string `json:"user_id"`
-				} `json:"payload"`
-			}{}
-			messageBody.EventType = "user_created"
-			messageBody.Payload.UserID = userID
-			if err := h.sqs.SendMessage(todospoc.Config.UserEventsQueueName, messageBody); err != nil {
+		u := user{Username: username, Email: email, ProvisioningStatus: userStatusPending}
+		userID, err := h.store.saveUser(username, email, func(userID string) error {
+			if u.awaitingVerification() {
+				return nil
+			}
+			e, err := newEvent(userCreatedEvent, logging.RequestID(r.Context()), userCreatedPayload{UserID: userID})
+			if err != nil {
 				return err
 			}
-			return nil
+			return h.sqs.SendMessage(todospoc.Config.UserEventsQueueName, e)
 		})
 
+		// emails are only unique once verified, so this is the username and
+		// signing up doesn't tell whether an email is registered
 		if pgerr, ok := err.(*pq.Error); ok && pgerr.Code == "23505" {
-			utils.WriteJSON(w, http.StatusConflict, errors.New("username already exists"))
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusConflict, "username_taken", "username already exists"))
 			return
 		}
 
 		if err != nil {
-			log.Println(err)
-			utils.WriteStandardErrorJSON(w, http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
 			return
 		}
+		u.ID = userID
+
+		if email.Valid && !h.emailVerifiedByOther(r, u) {
+			if err := h.sendVerificationEmail(u); err != nil {
+				logging.FromContext(r.Context()).With(logging.Fields{"user_id": userID}).Errorf("%v", err)
+			}
+		}
+
+		if timeout := todospoc.Config.SyncProvisioningTimeout; timeout > 0 && !u.awaitingVerification() && h.provisionInline(r, userID, timeout) {
+			u.ProvisioningStatus = userStatusActive
+		}
 
 		response := struct {
 			ID       string `json:"id"`
 			Username string `json:"username"`
-		}{userID, requestBody.Username}
+			Email    string `json:"email,omitempty"`
+			Status   string `json:"status"`
+		}{userID, username, email.String, u.status()}
 
 		utils.WriteJSON(w, http.StatusCreated, response)
 	}
@@ -97,64 +139,212 @@ func (h Handler) handleLogin() httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		var (
 			username    string
-			decoder     = json.NewDecoder(r.Body)
 			requestBody = struct {
 				Username string `json:"username"`
 			}{}
 		)
 
-		if err := decoder.Decode(&requestBody); err != nil {
-			log.Println(err)
-			utils.WriteStandardErrorJSON(w, http.StatusInternalServerError)
+		if err := utils.DecodeJSON(w, r, &requestBody); err != nil {
+			metrics.LoginFailures.WithLabelValues("invalid_request").Inc()
+			utils.WriteProblem(w, r, err)
 			return
 		}
 
-		if username = strings.TrimSpace(requestBody.Username); username == "" {
-			utils.WriteJSON(w, http.StatusBadRequest, errors.New("username can't be empty"))
+		if username = normalizeUsername(requestBody.Username); username == "" {
+			metrics.LoginFailures.WithLabelValues("invalid_request").Inc()
+			utils.WriteProblem(w, r, utils.ValidationError{{Field: "username", Message: "username can't be empty"}})
 			return
 		}
 
-		consumerID, err := h.store.getConsumerID(username)
+		var (
+			usernameKey  = throttleKey{throttleKeyUsername, strings.ToLower(username)}
+			throttleKeys = []throttleKey{usernameKey, {throttleKeyIP, clientIP(r)}}
+		)
+
+		lockedUntil, err := h.throttle.lockedUntil(throttleKeys)
+		if err != nil {
+			metrics.LoginFailures.WithLabelValues("error").Inc()
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+		if retryAfter := time.Until(lockedUntil); retryAfter > 0 {
+			metrics.LoginFailures.WithLabelValues("locked_out").Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusTooManyRequests, "too_many_attempts", "too many failed login attempts, try again later"))
+			return
+		}
+
+		u, err := h.store.getUserByUsername(username)
 
 		if err == sql.ErrNoRows {
-			utils.WriteStandardErrorJSON(w, http.StatusUnauthorized)
+			metrics.LoginFailures.WithLabelValues("unknown_user").Inc()
+			h.recordLoginFailure(r, throttleKeys)
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusUnauthorized, "invalid_credentials", ""))
 			return
 		}
 		if err != nil {
-			log.Println(err)
-			utils.WriteStandardErrorJSON(w, http.StatusInternalServerError)
+			metrics.LoginFailures.WithLabelValues("error").Inc()
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
 			return
 		}
 
-		jwtCredentials, err := h.kong.getJWTCredentials(consumerID)
-		if err != nil {
-			log.Println(err)
-			utils.WriteStandardErrorJSON(w, http.StatusInternalServerError)
+		if u.DisabledAt.Valid {
+			metrics.LoginFailures.WithLabelValues("disabled").Inc()
+			h.recordLoginFailure(r, throttleKeys)
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusForbidden, "account_disabled", "account is disabled"))
 			return
 		}
 
-		if len(jwtCredentials) == 0 {
-			log.Printf("no jwt credentials found for username: %v\n", username)
-			utils.WriteStandardErrorJSON(w, http.StatusInternalServerError)
+		if !h.writeJWT(w, r, u) {
 			return
 		}
 
-		jwt, err := craftJWT(jwtCredentials[0])
+		if err := h.throttle.reset(usernameKey); err != nil {
+			logging.FromContext(r.Context()).Errorf("could not reset failed logins: %v", err)
+		}
+	}
+}
+
+// writeJWT mints a token from the user's Kong JWT credentials, it reports
+// whether it succeeded or wrote an error response instead.
+func (h Handler) writeJWT(w http.ResponseWriter, r *http.Request, u user) bool {
+	if u.awaitingVerification() {
+		metrics.LoginFailures.WithLabelValues("email_not_verified").Inc()
+		utils.WriteProblem(w, r, utils.NewProblem(http.StatusForbidden, "email_not_verified", "email has not been verified"))
+		return false
+	}
+
+	switch u.ProvisioningStatus {
+	case userStatusPending:
+		metrics.LoginFailures.WithLabelValues("provisioning_pending").Inc()
+		w.Header().Set("Retry-After", strconv.Itoa(provisioningRetryAfter))
+		utils.WriteProblem(w, r, utils.NewProblem(http.StatusServiceUnavailable, "provisioning_pending", "account is still being provisioned, try again later"))
+		return false
+	case userStatusFailed:
+		metrics.LoginFailures.WithLabelValues("provisioning_failed").Inc()
+		utils.WriteProblem(w, r, utils.NewProblem(http.StatusConflict, "provisioning_failed", "account could not be provisioned"))
+		return false
+	}
+
+	if !u.ConsumerID.Valid {
+		err := fmt.Errorf("no api consumer found for username: %v", u.Username)
+		metrics.LoginFailures.WithLabelValues("no_credentials").Inc()
+		logging.FromContext(r.Context()).Errorf("%v", err)
+		utils.WriteProblem(w, r, err)
+		return false
+	}
+
+	jwtCredentials, err := h.kong.getJWTCredentials(u.ConsumerID.String)
+	if err != nil {
+		metrics.LoginFailures.WithLabelValues("error").Inc()
+		logging.FromContext(r.Context()).Errorf("%v", err)
+		utils.WriteProblem(w, r, err)
+		return false
+	}
+
+	if len(jwtCredentials) == 0 {
+		err := fmt.Errorf("no jwt credentials found for username: %v", u.Username)
+		metrics.LoginFailures.WithLabelValues("no_credentials").Inc()
+		logging.FromContext(r.Context()).Errorf("%v", err)
+		utils.WriteProblem(w, r, err)
+		return false
+	}
+
+	jwt, err := craftJWT(jwtCredentials[0], newTokenClaims(u))
+	if err != nil {
+		metrics.LoginFailures.WithLabelValues("error").Inc()
+		logging.FromContext(r.Context()).Errorf("%v", err)
+		utils.WriteProblem(w, r, err)
+		return false
+	}
+
+	response := struct {
+		JWT string `json:"jwt"`
+	}{jwt}
+
+	utils.WriteJSON(w, http.StatusOK, response)
+	return true
+}
+
+// provisionInline tries to provision the user's consumer within timeout. The
+// user_created event is already queued so the worker takes over when this
+// fails or is too slow. A slow attempt keeps running in the background until
+// the Kong request timeout and holds the user lock, so the worker waits for it
+// instead of provisioning twice.
+func (h Handler) provisionInline(r *http.Request, userID string, timeout time.Duration) bool {
+	logger := logging.FromContext(r.Context()).With(logging.Fields{"user_id": userID})
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if rcv := recover(); rcv != nil {
+				done <- fmt.Errorf("recovered from panic provisioning consumer: %v", rcv)
+			}
+		}()
+		done <- provisionConsumer(h.store, h.kong, userID)
+	}()
+
+	select {
+	case err := <-done:
 		if err != nil {
-			log.Println(err)
-			utils.WriteStandardErrorJSON(w, http.StatusInternalServerError)
-			return
+			metrics.SyncProvisioning.WithLabelValues("failed").Inc()
+			logger.Warnf("inline provisioning failed, deferring to worker: %v", err)
+			return false
 		}
+		metrics.SyncProvisioning.WithLabelValues("succeeded").Inc()
+		return true
+	case <-time.After(timeout):
+		metrics.SyncProvisioning.WithLabelValues("timeout").Inc()
+		logger.Warnf("inline provisioning timed out after %v, deferring to worker", timeout)
+		return false
+	}
+}
 
-		response := struct {
-			JWT string `json:"jwt"`
-		}{jwt}
+// handleGetUserStatus lets clients poll the provisioning status of a user
+// they just created before attempting to log in.
+func (h Handler) handleGetUserStatus() httprouter.Handle {
+	return h.withUser(func(w http.ResponseWriter, r *http.Request, u user) {
+		status := u.status()
+		if status == userStatusPending {
+			w.Header().Set("Retry-After", strconv.Itoa(provisioningRetryAfter))
+		}
+
+		utils.WriteJSON(w, http.StatusOK, struct {
+			ID     string `json:"id"`
+			Status string `json:"status"`
+		}{u.ID, status})
+	})
+}
 
-		utils.WriteJSON(w, http.StatusOK, response)
+// recordLoginFailure counts a failed login against every key and publishes a
+// user_locked_out event for each key that got locked out. Errors are only
+// logged since the login has already failed.
+func (h Handler) recordLoginFailure(r *http.Request, keys []throttleKey) {
+	logger := logging.FromContext(r.Context())
+	lockouts, err := h.throttle.recordFailure(keys, time.Now())
+	if err != nil {
+		logger.Errorf("could not record failed login: %v", err)
+		return
+	}
+	for _, l := range lockouts {
+		metrics.LoginLockouts.WithLabelValues(l.Key.Type).Inc()
+		logger.With(logging.Fields{"key": l.Key.String(), "locked_until": l.LockedUntil}).Warnf("login locked out")
+		e, err := newEvent(userLockedOutEvent, logging.RequestID(r.Context()), userLockedOutPayload{
+			KeyType:     l.Key.Type,
+			Key:         l.Key.Value,
+			LockedUntil: l.LockedUntil,
+		})
+		if err == nil {
+			err = h.sqs.SendMessage(todospoc.Config.UserEventsQueueName, e)
+		}
+		if err != nil {
+			logger.Errorf("%v", err)
+		}
 	}
 }
 
-func craftJWT(creds JWTCredentials) (string, error) {
+func craftJWT(creds JWTCredentials, claims tokenClaims) (string, error) {
 	header, err := json.Marshal(struct {
 		Alg string `json:"alg"`
 		Typ string `json:"typ"`
@@ -166,7 +356,8 @@ func craftJWT(creds JWTCredentials) (string, error) {
 
 	payload, err := json.Marshal(struct {
 		ISS string `json:"iss"`
-	}{creds.Key})
+		tokenClaims
+	}{creds.Key, claims})
 
 	if err != nil {
 		return "", fmt.Errorf("could not encode JWT payload: %v", err)
@@ -184,14 +375,53 @@ func craftJWT(creds JWTCredentials) (string, error) {
 	return strings.Join([]string{encodedHeaderAndPayload, sig}, "."), nil
 }
 
-func (h Handler) handleHealthCheck() httprouter.Handle {
-	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-		utils.WriteJSON(w, http.StatusOK, "OK")
+func (h Handler) setupRoutes() {
+	h.POST("/users", metrics.InstrumentHandle("POST", "/users", h.handleCreateUser()))
+	h.GET("/users/:id/status", metrics.InstrumentHandle("GET", "/users/:id/status", h.handleGetUserStatus()))
+	h.POST("/users/verify", metrics.InstrumentHandle("POST", "/users/verify", h.handleVerifyEmail()))
+	h.POST("/users/verify/resend", metrics.InstrumentHandle("POST", "/users/verify/resend", h.handleResendVerification()))
+	h.POST("/login", metrics.InstrumentHandle("POST", "/login", h.handleLogin()))
+	h.POST("/sessions/recover", metrics.InstrumentHandle("POST", "/sessions/recover", h.handleRecoverSessions()))
+	h.POST("/sessions/revoke", metrics.InstrumentHandle("POST", "/sessions/revoke", h.handleRevokeSessions()))
+	if h.idp != nil {
+		h.GET("/oidc/authorize", metrics.InstrumentHandle("GET", "/oidc/authorize", h.handleOIDCAuthorize()))
+		h.GET("/oidc/callback", metrics.InstrumentHandle("GET", "/oidc/callback", h.handleOIDCCallback()))
+		h.GET("/oidc/link", metrics.InstrumentHandle("GET", "/oidc/link", h.handleOIDCLink()))
 	}
+	h.setupAdminRoutes()
+
+	h.me.GET("/users/me", metrics.InstrumentHandle("GET", "/users/me", h.handleGetSignedInUser()))
+	h.me.GET("/users/me/api-keys", metrics.InstrumentHandle("GET", "/users/me/api-keys", h.handleListAPIKeys()))
+	h.me.POST("/users/me/api-keys", metrics.InstrumentHandle("POST", "/users/me/api-keys", h.handleCreateAPIKey()))
+	h.me.DELETE("/users/me/api-keys/:keyID", metrics.InstrumentHandle("DELETE", "/users/me/api-keys/:keyID", h.handleRevokeAPIKey()))
+	h.me.GET("/users/me/invitations", metrics.InstrumentHandle("GET", "/users/me/invitations", h.handleListInvitations()))
+	h.me.POST("/users/me/invitations/:invitationID/accept", metrics.InstrumentHandle("POST", "/users/me/invitations/:invitationID/accept", h.handleRespondToInvitation(true)))
+	h.me.POST("/users/me/invitations/:invitationID/decline", metrics.InstrumentHandle("POST", "/users/me/invitations/:invitationID/decline", h.handleRespondToInvitation(false)))
+
+	h.me.GET("/users/me/list-invitations", metrics.InstrumentHandle("GET", "/users/me/list-invitations", h.handleListListInvitations()))
+	h.me.POST("/users/me/list-invitations/:invitationID/accept", metrics.InstrumentHandle("POST", "/users/me/list-invitations/:invitationID/accept", h.handleRespondToListInvitation(true)))
+	h.me.POST("/users/me/list-invitations/:invitationID/decline", metrics.InstrumentHandle("POST", "/users/me/list-invitations/:invitationID/decline", h.handleRespondToListInvitation(false)))
+	h.me.POST("/users/me/share-links/redeem", metrics.InstrumentHandle("POST", "/users/me/share-links/redeem", h.handleRedeemShareLink()))
+
+	h.PUT("/lists/:listID/organization", metrics.InstrumentHandle("PUT", "/lists/:listID/organization", h.handleSetListOrganization()))
+	h.POST("/lists/:listID/invitations", metrics.InstrumentHandle("POST", "/lists/:listID/invitations", h.handleCreateListInvitation()))
+	h.POST("/lists/:listID/share-links", metrics.InstrumentHandle("POST", "/lists/:listID/share-links", h.handleCreateShareLink()))
+	h.DELETE("/lists/:listID/share-links/:linkID", metrics.InstrumentHandle("DELETE", "/lists/:listID/share-links/:linkID", h.handleRevokeShareLink()))
+
+	h.POST("/orgs", metrics.InstrumentHandle("POST", "/orgs", h.handleCreateOrganization()))
+	h.GET("/orgs", metrics.InstrumentHandle("GET", "/orgs", h.handleListOrganizations()))
+	h.GET("/orgs/:orgID", metrics.InstrumentHandle("GET", "/orgs/:orgID", h.handleGetOrganization()))
+	h.POST("/orgs/:orgID/invitations", metrics.InstrumentHandle("POST", "/orgs/:orgID/invitations", h.handleCreateOrganizationInvitation()))
+	h.PATCH("/orgs/:orgID/members/:userID", metrics.InstrumentHandle("PATCH", "/orgs/:orgID/members/:userID", h.handleUpdateOrganizationMember()))
+	h.DELETE("/orgs/:orgID/members/:userID", metrics.InstrumentHandle("DELETE", "/orgs/:orgID/members/:userID", h.handleRemoveOrganizationMember()))
 }
 
-func (h Handler) setupRoutes() {
-	h.POST("/users", h.handleCreateUser())
-	h.POST("/login", h.handleLogin())
-	h.GET("/_hc", h.handleHealthCheck())
+// ServeHTTP dispatches /users/me routes to their own router since httprouter
+// doesn't allow them next to /users/:id and /users/verify.
+func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == meRoutesPrefix || strings.HasPrefix(r.URL.Path, meRoutesPrefix+"/") {
+		h.me.ServeHTTP(w, r)
+		return
+	}
+	h.Router.ServeHTTP(w, r)
 }
@@ -0,0 +1,283 @@
+package users
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diorman/todospoc"
+	"github.com/diorman/todospoc/logging"
+	"github.com/diorman/todospoc/metrics"
+	"github.com/diorman/todospoc/oidc"
+	"github.com/diorman/todospoc/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/lib/pq"
+)
+
+const (
+	loginStateTTL = 10 * time.Minute
+
+	// loginStateCookie ties the state to the browser that started the flow
+	// so that an authorization URL can't be completed by someone else.
+	loginStateCookie = "oidc_state"
+
+	// consumerCustomIDHeader is set by the Kong JWT plugin with the custom id,
+	// i.e. the user id, of the authenticated consumer.
+	consumerCustomIDHeader = "X-Consumer-Custom-ID"
+)
+
+// IdentityProvider is an external OpenID Connect provider users can sign in
+// with, see oidc.Provider.
+type IdentityProvider interface {
+	Issuer() string
+	AuthCodeURL(state, nonce, codeChallenge string) (string, error)
+	Exchange(code, codeVerifier string) (string, error)
+	Verify(rawIDToken, nonce string) (*oidc.IDToken, error)
+}
+
+type identity struct {
+	Issuer  string
+	Subject string
+}
+
+// loginState is kept between redirecting to the provider and its callback.
+// LinkUserID is set when an already authenticated user is linking the
+// identity to their account.
+type loginState struct {
+	CodeVerifier string
+	Nonce        string
+	LinkUserID   sql.NullString
+	ExpiresAt    time.Time
+}
+
+func (h Handler) handleOIDCAuthorize() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		h.redirectToProvider(w, r, sql.NullString{})
+	}
+}
+
+// handleOIDCLink is only reachable through the Kong route protected by the
+// JWT plugin, which sets the custom id header.
+func (h Handler) handleOIDCLink() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		userID := r.Header.Get(consumerCustomIDHeader)
+		if !uuidPattern.MatchString(userID) {
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusUnauthorized, "unauthenticated", "linking an identity requires a signed in user"))
+			return
+		}
+		h.redirectToProvider(w, r, sql.NullString{String: userID, Valid: true})
+	}
+}
+
+func (h Handler) redirectToProvider(w http.ResponseWriter, r *http.Request, linkUserID sql.NullString) {
+	state, err := oidc.RandomString()
+	var nonce, verifier, challenge string
+	if err == nil {
+		nonce, err = oidc.RandomString()
+	}
+	if err == nil {
+		verifier, challenge, err = oidc.NewPKCE()
+	}
+	if err == nil {
+		err = h.store.saveLoginState(hashToken(state), loginState{
+			CodeVerifier: verifier,
+			Nonce:        nonce,
+			LinkUserID:   linkUserID,
+			ExpiresAt:    time.Now().Add(loginStateTTL),
+		})
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("%v", err)
+		utils.WriteProblem(w, r, err)
+		return
+	}
+
+	authURL, err := h.idp.AuthCodeURL(state, nonce, challenge)
+	if err != nil {
+		writeIdentityProviderProblem(w, r, err)
+		return
+	}
+	setLoginStateCookie(w, r, state, int(loginStateTTL/time.Second))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// setLoginStateCookie sets, or deletes with a negative maxAge, the cookie
+// checked by the callback. Lax lets it through the top level redirect back
+// from the provider.
+func setLoginStateCookie(w http.ResponseWriter, r *http.Request, state string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginStateCookie,
+		Value:    state,
+		Path:     "/oidc",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (h Handler) handleOIDCCallback() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		var (
+			query = r.URL.Query()
+			state = query.Get("state")
+			code  = query.Get("code")
+		)
+
+		if providerErr := query.Get("error"); providerErr != "" {
+			metrics.LoginFailures.WithLabelValues("oidc_denied").Inc()
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusUnauthorized, "oidc_denied", "identity provider returned "+providerErr))
+			return
+		}
+		if state == "" || code == "" {
+			metrics.LoginFailures.WithLabelValues("invalid_request").Inc()
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusBadRequest, "invalid_request", "code and state are required"))
+			return
+		}
+
+		cookie, err := r.Cookie(loginStateCookie)
+		if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+			metrics.LoginFailures.WithLabelValues("invalid_request").Inc()
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusBadRequest, "invalid_state", "login was started in another browser"))
+			return
+		}
+		setLoginStateCookie(w, r, "", -1)
+
+		st, err := h.store.consumeLoginState(hashToken(state))
+		if err == sql.ErrNoRows {
+			metrics.LoginFailures.WithLabelValues("invalid_request").Inc()
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusBadRequest, "invalid_state", "login state is invalid or has expired"))
+			return
+		}
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+
+		rawIDToken, err := h.idp.Exchange(code, st.CodeVerifier)
+		if err != nil {
+			writeIdentityProviderProblem(w, r, err)
+			return
+		}
+		token, err := h.idp.Verify(rawIDToken, st.Nonce)
+		if err != nil {
+			metrics.LoginFailures.WithLabelValues("invalid_id_token").Inc()
+			logging.FromContext(r.Context()).Warnf("%v", err)
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusUnauthorized, "invalid_id_token", ""))
+			return
+		}
+		id := identity{Issuer: token.Issuer, Subject: token.Subject}
+
+		if st.LinkUserID.Valid {
+			h.linkIdentity(w, r, st.LinkUserID.String, id)
+			return
+		}
+
+		u, err := h.store.getUserByIdentity(id)
+		if err == sql.ErrNoRows {
+			h.createIdentityUser(w, r, id, token)
+			return
+		}
+		if err != nil {
+			metrics.LoginFailures.WithLabelValues("error").Inc()
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+
+		if u.DisabledAt.Valid {
+			metrics.LoginFailures.WithLabelValues("disabled").Inc()
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusForbidden, "account_disabled", "account is disabled"))
+			return
+		}
+
+		h.writeJWT(w, r, u)
+	}
+}
+
+func (h Handler) linkIdentity(w http.ResponseWriter, r *http.Request, userID string, id identity) {
+	err := h.store.linkIdentity(userID, id)
+	if pgerr, ok := err.(*pq.Error); ok && pgerr.Code == "23505" {
+		utils.WriteProblem(w, r, utils.NewProblem(http.StatusConflict, "identity_already_linked", "identity is already linked to an account"))
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("%v", err)
+		utils.WriteProblem(w, r, err)
+		return
+	}
+
+	response := struct {
+		ID      string `json:"id"`
+		Issuer  string `json:"issuer"`
+		Subject string `json:"subject"`
+	}{userID, id.Issuer, id.Subject}
+
+	utils.WriteJSON(w, http.StatusOK, response)
+}
+
+// createIdentityUser signs up the owner of an unknown identity. The username
+// comes from the ID token, when it's unusable or taken the user has to sign
+// up with a username and link the identity instead.
+func (h Handler) createIdentityUser(w http.ResponseWriter, r *http.Request, id identity, token *oidc.IDToken) {
+	username := normalizeUsername(token.PreferredUsername)
+	if username == "" {
+		username = normalizeUsername(strings.SplitN(token.Email, "@", 2)[0])
+	}
+	if validateUsername(username) != nil {
+		utils.WriteProblem(w, r, utils.NewProblem(http.StatusConflict, "account_link_required", "sign up with a username and link this identity to it"))
+		return
+	}
+
+	var email sql.NullString
+	if token.EmailVerified && validateEmail(token.Email) == nil {
+		email = sql.NullString{String: token.Email, Valid: true}
+	}
+
+	userID, err := h.store.saveUserWithIdentity(username, email, id, func(userID string) error {
+		e, err := newEvent(userCreatedEvent, logging.RequestID(r.Context()), userCreatedPayload{UserID: userID})
+		if err != nil {
+			return err
+		}
+		return h.sqs.SendMessage(todospoc.Config.UserEventsQueueName, e)
+	})
+
+	if pgerr, ok := err.(*pq.Error); ok && pgerr.Code == "23505" {
+		utils.WriteProblem(w, r, utils.NewProblem(http.StatusConflict, "account_link_required", "username or email already in use, sign in and link this identity instead"))
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("%v", err)
+		utils.WriteProblem(w, r, err)
+		return
+	}
+
+	u := user{ID: userID, Username: username, Email: email, ProvisioningStatus: userStatusPending}
+	if timeout := todospoc.Config.SyncProvisioningTimeout; timeout > 0 && h.provisionInline(r, userID, timeout) {
+		if u, err = h.store.getUser(userID); err == nil {
+			h.writeJWT(w, r, u)
+			return
+		}
+		logging.FromContext(r.Context()).Errorf("%v", err)
+	}
+
+	response := struct {
+		ID       string `json:"id"`
+		Username string `json:"username"`
+		Status   string `json:"status"`
+	}{userID, username, userStatusPending}
+
+	w.Header().Set("Retry-After", strconv.Itoa(provisioningRetryAfter))
+	utils.WriteJSON(w, http.StatusAccepted, response)
+}
+
+func writeIdentityProviderProblem(w http.ResponseWriter, r *http.Request, err error) {
+	metrics.LoginFailures.WithLabelValues("error").Inc()
+	logging.FromContext(r.Context()).Errorf("%v", err)
+	utils.WriteProblem(w, r, utils.NewProblem(http.StatusBadGateway, "identity_provider_unavailable", "could not complete sign in with the identity provider"))
+}
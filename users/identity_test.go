@@ -0,0 +1,188 @@
+package users
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/diorman/todospoc/oidc"
+	"github.com/diorman/todospoc/oidc/oidctest"
+	"github.com/julienschmidt/httprouter"
+	"github.com/lib/pq"
+)
+
+// signInWithProvider starts the flow at path on h, as signedInUserID when
+// set, lets the stand-in provider approve it and returns the response to the
+// callback. The callback gets the cookies set when starting the flow unless
+// otherBrowser is set.
+func signInWithProvider(t *testing.T, h Handler, path, signedInUserID string, otherBrowser bool) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("GET", path, nil)
+	if signedInUserID != "" {
+		r.Header.Set(consumerCustomIDHeader, signedInUserID)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusFound {
+		return w
+	}
+	cookies := w.Result().Cookies()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	res, err := client.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	res.Body.Close()
+	callback, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	r, _ = http.NewRequest("GET", callback.RequestURI(), nil)
+	if !otherBrowser {
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestOIDCSignIn(t *testing.T) {
+	server := oidctest.NewServer("todospoc")
+	defer server.Close()
+	idp := oidc.NewProvider(server.Issuer(), "todospoc", "", "http://localhost/oidc/callback")
+
+	tests := map[string]struct {
+		path                 string
+		signedInUserID       string
+		statusCode           int
+		responseBody         string
+		storeIdentityUser    user
+		storeIdentityUserErr error
+		storeSaveUserErr     error
+		otherBrowser         bool
+		linkedIdentities     int
+		sentMessages         int
+	}{
+		"returns 200 and a jwt for a linked identity": {
+			path:              "/oidc/authorize",
+			statusCode:        http.StatusOK,
+			responseBody:      fmt.Sprintf(`{"jwt":"%v"}`, testJWT),
+			storeIdentityUser: testUser,
+		},
+		"returns 403 for a linked identity of a disabled user": {
+			path:              "/oidc/authorize",
+			statusCode:        http.StatusForbidden,
+			responseBody:      `{"type":"about:blank","title":"Forbidden","status":403,"detail":"account is disabled","instance":"/oidc/callback","code":"account_disabled"}`,
+			storeIdentityUser: testDisabledUser,
+		},
+		"returns 202 and signs up the owner of an unknown identity": {
+			path:                 "/oidc/authorize",
+			statusCode:           http.StatusAccepted,
+			responseBody:         `{"id":"123","username":"oidctest-user","status":"pending"}`,
+			storeIdentityUserErr: sql.ErrNoRows,
+			linkedIdentities:     1,
+			sentMessages:         1,
+		},
+		"returns 409 when the username of an unknown identity is taken": {
+			path:                 "/oidc/authorize",
+			statusCode:           http.StatusConflict,
+			responseBody:         `{"type":"about:blank","title":"Conflict","status":409,"detail":"username or email already in use, sign in and link this identity instead","instance":"/oidc/callback","code":"account_link_required"}`,
+			storeIdentityUserErr: sql.ErrNoRows,
+			storeSaveUserErr:     &pq.Error{Code: "23505"},
+		},
+		"returns 200 and links the identity to the signed in user": {
+			path:             "/oidc/link",
+			signedInUserID:   testUser.ID,
+			statusCode:       http.StatusOK,
+			responseBody:     fmt.Sprintf(`{"id":"%v","issuer":"%v","subject":"oidctest-user"}`, testUser.ID, server.Issuer()),
+			linkedIdentities: 1,
+		},
+		"returns 400 when the link is completed in another browser": {
+			path:           "/oidc/link",
+			signedInUserID: testUser.ID,
+			otherBrowser:   true,
+			statusCode:     http.StatusBadRequest,
+			responseBody:   `{"type":"about:blank","title":"Bad Request","status":400,"detail":"login was started in another browser","instance":"/oidc/callback","code":"invalid_state"}`,
+		},
+		"returns 401 when linking without a signed in user": {
+			path:         "/oidc/link",
+			statusCode:   http.StatusUnauthorized,
+			responseBody: `{"type":"about:blank","title":"Unauthorized","status":401,"detail":"linking an identity requires a signed in user","instance":"/oidc/link","code":"unauthenticated"}`,
+		},
+	}
+
+	for td, tt := range tests {
+		s := testStore{}
+		s.getUserByIdentityReturn.user = tt.storeIdentityUser
+		s.getUserByIdentityReturn.err = tt.storeIdentityUserErr
+		s.saveUserReturn.userID = "123"
+		s.saveUserReturn.err = tt.storeSaveUserErr
+		k := testKongClient{}
+		k.getJWTCredentialsReturn.jwtCredentials = []JWTCredentials{testJWTCredentials}
+		sqsClient := testSQSClient{}
+
+		h := NewHandler(httprouter.New(), &s, &k, &sqsClient, &testLoginThrottle{}, &testMailer{}, idp)
+		w := signInWithProvider(t, h, tt.path, tt.signedInUserID, tt.otherBrowser)
+
+		if tt.statusCode != w.Code {
+			t.Errorf("%v: handler returned wrong status code: expected %v, got %v", td, tt.statusCode, w.Code)
+		}
+
+		if tt.responseBody != w.Body.String() {
+			t.Errorf("%v: handler returned wrong body: expected %v, got %v", td, tt.responseBody, w.Body.String())
+		}
+
+		if len(s.linkedIdentities) != tt.linkedIdentities {
+			t.Errorf("%v: wrong number of linked identities: expected %v, got %v", td, tt.linkedIdentities, len(s.linkedIdentities))
+		}
+
+		if len(sqsClient.sentMessages) != tt.sentMessages {
+			t.Errorf("%v: wrong number of events: expected %v, got %v", td, tt.sentMessages, len(sqsClient.sentMessages))
+		}
+	}
+}
+
+func TestOIDCCallbackRejectsUnknownState(t *testing.T) {
+	server := oidctest.NewServer("todospoc")
+	defer server.Close()
+	idp := oidc.NewProvider(server.Issuer(), "todospoc", "", "http://localhost/oidc/callback")
+
+	tests := map[string]struct {
+		cookie       string
+		responseBody string
+	}{
+		"without the state cookie": {
+			responseBody: `{"type":"about:blank","title":"Bad Request","status":400,"detail":"login was started in another browser","instance":"/oidc/callback","code":"invalid_state"}`,
+		},
+		"with a cookie of another state": {
+			cookie:       "other",
+			responseBody: `{"type":"about:blank","title":"Bad Request","status":400,"detail":"login was started in another browser","instance":"/oidc/callback","code":"invalid_state"}`,
+		},
+		"with an unknown state": {
+			cookie:       "unknown",
+			responseBody: `{"type":"about:blank","title":"Bad Request","status":400,"detail":"login state is invalid or has expired","instance":"/oidc/callback","code":"invalid_state"}`,
+		},
+	}
+
+	for td, tt := range tests {
+		h := NewHandler(httprouter.New(), &testStore{}, &testKongClient{}, &testSQSClient{}, &testLoginThrottle{}, &testMailer{}, idp)
+		r, _ := http.NewRequest("GET", "/oidc/callback?code=abc&state=unknown", nil)
+		if tt.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: loginStateCookie, Value: tt.cookie})
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != http.StatusBadRequest || w.Body.String() != tt.responseBody {
+			t.Errorf("%v: unexpected response: %v %v", td, w.Code, w.Body.String())
+		}
+	}
+}
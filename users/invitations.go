@@ -0,0 +1,97 @@
+package users
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/diorman/todospoc"
+	"github.com/diorman/todospoc/logging"
+	"github.com/diorman/todospoc/mail"
+	"github.com/diorman/todospoc/utils"
+)
+
+// inviteeRequest names who an organization or list invitation is for, either
+// by username or by email.
+type inviteeRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+// validate normalizes the username and email and returns their field errors.
+func (req *inviteeRequest) validate() utils.ValidationError {
+	req.Username = normalizeUsername(req.Username)
+	req.Email = normalizeEmail(req.Email)
+
+	var fieldErrors utils.ValidationError
+	switch {
+	case req.Username == "" && req.Email == "":
+		fieldErrors = append(fieldErrors, utils.FieldError{Field: "username", Message: "either username or email is required"})
+	case req.Username != "" && req.Email != "":
+		fieldErrors = append(fieldErrors, utils.FieldError{Field: "username", Message: "only one of username or email can be given"})
+	case req.Email != "":
+		if err := validateEmail(req.Email); err != nil {
+			fieldErrors = append(fieldErrors, err.(utils.ValidationError)...)
+		}
+	}
+	return fieldErrors
+}
+
+// invitee is who an invitation is addressed to, the user when the invitation
+// is bound to an account and the email otherwise.
+type invitee struct {
+	user   user
+	userID sql.NullString
+	email  sql.NullString
+}
+
+// resolveInvitee binds the invitation to the invitee's account when named by
+// username or by an email the account verified. An unverified email may
+// belong to someone else so only the email is kept and the invitation goes to
+// whoever verifies it. The error is ready for utils.WriteProblem.
+func (h Handler) resolveInvitee(r *http.Request, req inviteeRequest) (invitee, error) {
+	var (
+		u   user
+		err error
+	)
+	if req.Username != "" {
+		u, err = h.store.getUserByUsername(req.Username)
+	} else {
+		u, err = h.store.getUserByEmail(req.Email)
+	}
+	switch {
+	case err == sql.ErrNoRows && req.Username != "":
+		return invitee{}, utils.ValidationError{{Field: "username", Message: "user not found"}}
+	case err != nil && err != sql.ErrNoRows:
+		logging.FromContext(r.Context()).Errorf("%v", err)
+		return invitee{}, err
+	case err == sql.ErrNoRows, req.Email != "" && !u.EmailVerifiedAt.Valid:
+		return invitee{email: sql.NullString{String: req.Email, Valid: true}}, nil
+	}
+	return invitee{user: u, userID: sql.NullString{String: u.ID, Valid: true}}, nil
+}
+
+// notifyInvitee publishes the invitation event and emails msg to the invitee
+// when there's an address to email. The invitation is already saved and
+// listed to the invitee so failures are only logged.
+func (h Handler) notifyInvitee(r *http.Request, invitationID string, to invitee, eventType string, payload interface{}, msg mail.Message) {
+	logger := logging.FromContext(r.Context()).With(logging.Fields{"invitation_id": invitationID})
+
+	e, err := newEvent(eventType, logging.RequestID(r.Context()), payload)
+	if err == nil {
+		err = h.sqs.SendMessage(todospoc.Config.UserEventsQueueName, e)
+	}
+	if err != nil {
+		logger.Errorf("%v", err)
+	}
+
+	msg.To = to.email.String
+	if to.user.Email.Valid && to.user.EmailVerifiedAt.Valid {
+		msg.To = to.user.Email.String
+	}
+	if msg.To == "" {
+		return
+	}
+	if err := h.mailer.Send(msg); err != nil {
+		logger.Errorf("could not email invitation: %v", err)
+	}
+}
@@ -6,32 +6,79 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/diorman/todospoc/metrics"
 )
 
 type JWTCredentials struct {
+	ID        string `json:"id,omitempty"`
 	Key       string `json:"key"`
 	Algorithm string `json:"algorithm"`
 	Secret    string `json:"secret"`
 }
 
+type KongConsumer struct {
+	ID        string `json:"id"`
+	CustomID  string `json:"custom_id"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// createdBefore reports whether the consumer is older than d, Kong reports
+// created_at in milliseconds.
+func (c KongConsumer) createdBefore(d time.Duration) bool {
+	return time.Since(time.Unix(0, c.CreatedAt*int64(time.Millisecond))) > d
+}
+
+type KongACL struct {
+	ID    string `json:"id"`
+	Group string `json:"group"`
+}
+
 type KongClient interface {
 	createConsumer(userID string) (string, error)
+	getConsumer(consumerID string) (*KongConsumer, error)
+	findConsumerByCustomID(userID string) (*KongConsumer, error)
+	listConsumers() ([]KongConsumer, error)
+	deleteConsumer(consumerID string) error
 	createJWTCredentials(consumerID string) error
 	getJWTCredentials(consumerID string) ([]JWTCredentials, error)
+	deleteJWTCredentials(consumerID string) error
+	createKeyAuthCredentials(consumerID, key string) (string, error)
+	deleteKeyAuthCredential(consumerID, credentialID string) error
+	deleteKeyAuthCredentials(consumerID string) error
+	listACLGroups(consumerID string) ([]KongACL, error)
+	addACLGroup(consumerID, group string) error
+	deleteACLGroup(consumerID, aclID string) error
 }
 
+// kongRequestTimeout bounds every call to the Kong admin API so that
+// provisioning can't hang on an unresponsive gateway.
+const kongRequestTimeout = 10 * time.Second
+
 type kongClientImpl struct {
 	address string
+	client  *http.Client
 }
 
 func NewKongClient(address string) KongClient {
-	return &kongClientImpl{address}
+	return &kongClientImpl{address, &http.Client{Timeout: kongRequestTimeout}}
 }
 
-func (kong *kongClientImpl) createConsumer(userID string) (string, error) {
+func observeKongCall(operation string, start time.Time, err *error) {
+	metrics.KongRequestDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if *err != nil {
+		metrics.KongRequestErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+func (kong *kongClientImpl) createConsumer(userID string) (consumerID string, err error) {
+	defer observeKongCall("create_consumer", time.Now(), &err)
+
 	body := []byte(fmt.Sprintf(`{"custom_id": "%v"}`, userID))
 
-	r, err := http.Post(fmt.Sprintf("%s/consumers", kong.address), "application/json", bytes.NewBuffer(body))
+	r, err := kong.client.Post(fmt.Sprintf("%s/consumers", kong.address), "application/json", bytes.NewBuffer(body))
 	if err != nil {
 		return "", fmt.Errorf("could not create Kong consumer: %v", err)
 	}
@@ -57,8 +104,10 @@ func (kong *kongClientImpl) createConsumer(userID string) (string, error) {
 	return response.ID, nil
 }
 
-func (kong *kongClientImpl) createJWTCredentials(consumerID string) error {
-	r, err := http.Post(fmt.Sprintf("%s/consumers/%s/jwt", kong.address, consumerID), "application/json", bytes.NewBuffer([]byte("{}")))
+func (kong *kongClientImpl) createJWTCredentials(consumerID string) (err error) {
+	defer observeKongCall("create_jwt_credentials", time.Now(), &err)
+
+	r, err := kong.client.Post(fmt.Sprintf("%s/consumers/%s/jwt", kong.address, consumerID), "application/json", bytes.NewBuffer([]byte("{}")))
 	if err != nil {
 		return fmt.Errorf("could not create Kong JWT credentials: %v", err)
 	}
@@ -76,8 +125,10 @@ func (kong *kongClientImpl) createJWTCredentials(consumerID string) error {
 	return nil
 }
 
-func (kong *kongClientImpl) getJWTCredentials(consumerID string) ([]JWTCredentials, error) {
-	r, err := http.Get(fmt.Sprintf("%s/consumers/%s/jwt", kong.address, consumerID))
+func (kong *kongClientImpl) getJWTCredentials(consumerID string) (credentials []JWTCredentials, err error) {
+	defer observeKongCall("get_jwt_credentials", time.Now(), &err)
+
+	r, err := kong.client.Get(fmt.Sprintf("%s/consumers/%s/jwt", kong.address, consumerID))
 	if err != nil {
 		return nil, fmt.Errorf("could not fetch Kong JWT credentials: %v", err)
 	}
@@ -97,3 +148,242 @@ func (kong *kongClientImpl) getJWTCredentials(consumerID string) ([]JWTCredentia
 
 	return responseBody.Data, nil
 }
+
+// getConsumer returns nil when the consumer does not exist.
+func (kong *kongClientImpl) getConsumer(consumerID string) (consumer *KongConsumer, err error) {
+	defer observeKongCall("get_consumer", time.Now(), &err)
+
+	r, err := kong.client.Get(fmt.Sprintf("%s/consumers/%s", kong.address, consumerID))
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch Kong consumer: %v", err)
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if r.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response fetching Kong consumer: %d", r.StatusCode)
+	}
+
+	consumer = &KongConsumer{}
+	if err := json.NewDecoder(r.Body).Decode(consumer); err != nil {
+		return nil, fmt.Errorf("could not decode Kong consumer response: %v", err)
+	}
+	return consumer, nil
+}
+
+// findConsumerByCustomID returns nil when no consumer has the given custom id.
+func (kong *kongClientImpl) findConsumerByCustomID(userID string) (consumer *KongConsumer, err error) {
+	defer observeKongCall("find_consumer", time.Now(), &err)
+
+	page, err := kong.getConsumersPage(fmt.Sprintf("%s/consumers?custom_id=%s", kong.address, url.QueryEscape(userID)))
+	if err != nil {
+		return nil, err
+	}
+	if len(page.Data) == 0 {
+		return nil, nil
+	}
+	return &page.Data[0], nil
+}
+
+func (kong *kongClientImpl) listConsumers() (consumers []KongConsumer, err error) {
+	defer observeKongCall("list_consumers", time.Now(), &err)
+
+	consumers = []KongConsumer{}
+	offset := ""
+	for {
+		u := fmt.Sprintf("%s/consumers?size=1000", kong.address)
+		if offset != "" {
+			u += "&offset=" + url.QueryEscape(offset)
+		}
+		page, err := kong.getConsumersPage(u)
+		if err != nil {
+			return nil, err
+		}
+		consumers = append(consumers, page.Data...)
+		if page.Offset == "" {
+			return consumers, nil
+		}
+		offset = page.Offset
+	}
+}
+
+type kongConsumersPage struct {
+	Data   []KongConsumer `json:"data"`
+	Offset string         `json:"offset"`
+}
+
+func (kong *kongClientImpl) getConsumersPage(u string) (*kongConsumersPage, error) {
+	r, err := kong.client.Get(u)
+	if err != nil {
+		return nil, fmt.Errorf("could not list Kong consumers: %v", err)
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response listing Kong consumers: %d", r.StatusCode)
+	}
+
+	page := &kongConsumersPage{}
+	if err := json.NewDecoder(r.Body).Decode(page); err != nil {
+		return nil, fmt.Errorf("could not decode Kong consumers response: %v", err)
+	}
+	return page, nil
+}
+
+func (kong *kongClientImpl) deleteConsumer(consumerID string) (err error) {
+	defer observeKongCall("delete_consumer", time.Now(), &err)
+
+	return kong.delete(fmt.Sprintf("%s/consumers/%s", kong.address, consumerID))
+}
+
+func (kong *kongClientImpl) deleteJWTCredentials(consumerID string) (err error) {
+	defer observeKongCall("delete_jwt_credentials", time.Now(), &err)
+
+	credentials, err := kong.getJWTCredentials(consumerID)
+	if err != nil {
+		return err
+	}
+	for _, c := range credentials {
+		if err := kong.delete(fmt.Sprintf("%s/consumers/%s/jwt/%s", kong.address, consumerID, c.ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (kong *kongClientImpl) createKeyAuthCredentials(consumerID, key string) (credentialID string, err error) {
+	defer observeKongCall("create_key_auth_credentials", time.Now(), &err)
+
+	body, err := json.Marshal(struct {
+		Key string `json:"key"`
+	}{key})
+	if err != nil {
+		return "", err
+	}
+
+	r, err := kong.client.Post(fmt.Sprintf("%s/consumers/%s/key-auth", kong.address, consumerID), "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return "", fmt.Errorf("could not create Kong key-auth credentials: %v", err)
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("unexpected response creating Kong key-auth credentials: %d", r.StatusCode)
+	}
+
+	response := struct {
+		ID string `json:"id"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&response); err != nil {
+		return "", fmt.Errorf("could not decode Kong key-auth credentials response: %v", err)
+	}
+	return response.ID, nil
+}
+
+func (kong *kongClientImpl) deleteKeyAuthCredential(consumerID, credentialID string) (err error) {
+	defer observeKongCall("delete_key_auth_credential", time.Now(), &err)
+
+	return kong.delete(fmt.Sprintf("%s/consumers/%s/key-auth/%s", kong.address, consumerID, credentialID))
+}
+
+func (kong *kongClientImpl) deleteKeyAuthCredentials(consumerID string) (err error) {
+	defer observeKongCall("delete_key_auth_credentials", time.Now(), &err)
+
+	r, err := kong.client.Get(fmt.Sprintf("%s/consumers/%s/key-auth", kong.address, consumerID))
+	if err != nil {
+		return fmt.Errorf("could not fetch Kong key-auth credentials: %v", err)
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response fetching Kong key-auth credentials: %d", r.StatusCode)
+	}
+
+	response := struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&response); err != nil {
+		return fmt.Errorf("could not decode Kong key-auth credentials response: %v", err)
+	}
+	for _, c := range response.Data {
+		if err := kong.delete(fmt.Sprintf("%s/consumers/%s/key-auth/%s", kong.address, consumerID, c.ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (kong *kongClientImpl) listACLGroups(consumerID string) (acls []KongACL, err error) {
+	defer observeKongCall("list_acl_groups", time.Now(), &err)
+
+	r, err := kong.client.Get(fmt.Sprintf("%s/consumers/%s/acls", kong.address, consumerID))
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch Kong ACL groups: %v", err)
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response fetching Kong ACL groups: %d", r.StatusCode)
+	}
+
+	response := struct {
+		Data []KongACL `json:"data"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("could not decode Kong ACL groups response: %v", err)
+	}
+	return response.Data, nil
+}
+
+func (kong *kongClientImpl) addACLGroup(consumerID, group string) (err error) {
+	defer observeKongCall("add_acl_group", time.Now(), &err)
+
+	body, err := json.Marshal(struct {
+		Group string `json:"group"`
+	}{group})
+	if err != nil {
+		return err
+	}
+
+	r, err := kong.client.Post(fmt.Sprintf("%s/consumers/%s/acls", kong.address, consumerID), "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return fmt.Errorf("could not add Kong ACL group: %v", err)
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusCreated && r.StatusCode != http.StatusConflict {
+		return fmt.Errorf("unexpected response adding Kong ACL group %s: %d", group, r.StatusCode)
+	}
+	return nil
+}
+
+func (kong *kongClientImpl) deleteACLGroup(consumerID, aclID string) (err error) {
+	defer observeKongCall("delete_acl_group", time.Now(), &err)
+
+	return kong.delete(fmt.Sprintf("%s/consumers/%s/acls/%s", kong.address, consumerID, aclID))
+}
+
+// delete treats a missing resource as already deleted.
+func (kong *kongClientImpl) delete(url string) error {
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return err
+	}
+	r, err := kong.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not delete Kong resource: %v", err)
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusNoContent && r.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("unexpected response deleting Kong resource %s: %d", url, r.StatusCode)
+	}
+	return nil
+}
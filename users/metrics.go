@@ -0,0 +1,26 @@
+package users
+
+import (
+	"math"
+
+	"github.com/diorman/todospoc/logging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// NewProvisioningBacklogCollector reports the users whose user_created event
+// has not been processed by the worker yet, i.e. those without a Kong consumer.
+func NewProvisioningBacklogCollector(s Store) prometheus.Collector {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "todospoc",
+		Subsystem: "users",
+		Name:      "provisioning_backlog",
+		Help:      "Users waiting for a Kong consumer to be provisioned.",
+	}, func() float64 {
+		count, err := s.countUnprovisionedUsers()
+		if err != nil {
+			logging.Default().Errorf("could not count unprovisioned users: %v", err)
+			return math.NaN()
+		}
+		return float64(count)
+	})
+}
@@ -0,0 +1,532 @@
+package users
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/diorman/todospoc/logging"
+	"github.com/diorman/todospoc/mail"
+	"github.com/diorman/todospoc/utils"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// The permission levels are the values of the type column of the permissions
+// table, organizations grant one of them to their members on every list they
+// own, see the list_access view.
+const (
+	permissionRead  = 1
+	permissionWrite = 2
+)
+
+var permissionNames = map[int]string{
+	permissionRead:  "read",
+	permissionWrite: "write",
+}
+
+const (
+	orgRoleOwner  = "owner"
+	orgRoleAdmin  = "admin"
+	orgRoleMember = "member"
+
+	invitationStatusPending  = "pending"
+	invitationStatusAccepted = "accepted"
+	invitationStatusDeclined = "declined"
+	invitationStatusExpired  = "expired"
+
+	organizationNameMaxLength = 100
+	invitationTTL             = 7 * 24 * time.Hour
+
+	orgsReadScope  = "orgs:read"
+	orgsWriteScope = "orgs:write"
+)
+
+var orgRoles = map[string]bool{
+	orgRoleOwner:  true,
+	orgRoleAdmin:  true,
+	orgRoleMember: true,
+}
+
+// organization is always loaded on behalf of one of its members, Role is the
+// role of that member.
+type organization struct {
+	ID               string
+	Name             string
+	MemberPermission int
+	Role             string
+	CreatedAt        time.Time
+}
+
+func (o organization) manageable() bool {
+	return o.Role == orgRoleOwner || o.Role == orgRoleAdmin
+}
+
+type organizationMember struct {
+	UserID    string
+	Username  string
+	Role      string
+	CreatedAt time.Time
+}
+
+type organizationInvitation struct {
+	ID               string
+	OrganizationID   string
+	OrganizationName string
+	InvitedBy        string
+	InviteeUserID    sql.NullString
+	InviteeEmail     sql.NullString
+	Role             string
+	Status           string
+	ExpiresAt        time.Time
+	CreatedAt        time.Time
+}
+
+func (inv organizationInvitation) status() string {
+	if inv.Status == invitationStatusPending && !inv.ExpiresAt.After(time.Now()) {
+		return invitationStatusExpired
+	}
+	return inv.Status
+}
+
+type organizationResponse struct {
+	ID               string    `json:"id"`
+	Name             string    `json:"name"`
+	MemberPermission string    `json:"member_permission"`
+	Role             string    `json:"role"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+func newOrganizationResponse(o organization) organizationResponse {
+	return organizationResponse{
+		ID:               o.ID,
+		Name:             o.Name,
+		MemberPermission: permissionNames[o.MemberPermission],
+		Role:             o.Role,
+		CreatedAt:        o.CreatedAt,
+	}
+}
+
+type organizationMemberResponse struct {
+	UserID    string    `json:"user_id"`
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type invitationResponse struct {
+	ID               string    `json:"id"`
+	OrganizationID   string    `json:"organization_id"`
+	OrganizationName string    `json:"organization_name"`
+	InviteeUserID    *string   `json:"invitee_user_id"`
+	InviteeEmail     *string   `json:"invitee_email"`
+	Role             string    `json:"role"`
+	Status           string    `json:"status"`
+	ExpiresAt        time.Time `json:"expires_at"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+func newInvitationResponse(inv organizationInvitation) invitationResponse {
+	res := invitationResponse{
+		ID:               inv.ID,
+		OrganizationID:   inv.OrganizationID,
+		OrganizationName: inv.OrganizationName,
+		Role:             inv.Role,
+		Status:           inv.status(),
+		ExpiresAt:        inv.ExpiresAt,
+		CreatedAt:        inv.CreatedAt,
+	}
+	if inv.InviteeUserID.Valid {
+		res.InviteeUserID = &inv.InviteeUserID.String
+	}
+	if inv.InviteeEmail.Valid {
+		res.InviteeEmail = &inv.InviteeEmail.String
+	}
+	return res
+}
+
+func parsePermission(name string) (int, bool) {
+	for level, n := range permissionNames {
+		if n == name {
+			return level, true
+		}
+	}
+	return 0, false
+}
+
+// withOrganization loads the organization referenced by the :orgID route
+// parameter on behalf of the signed in user, organizations the user isn't a
+// member of are reported as not found.
+func (h Handler) withOrganization(scope string, handle func(http.ResponseWriter, *http.Request, httprouter.Params, user, organization)) httprouter.Handle {
+	return h.requireScope(scope, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params, u user) {
+		orgID := ps.ByName("orgID")
+		if !uuidPattern.MatchString(orgID) {
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusNotFound, "organization_not_found", ""))
+			return
+		}
+		o, err := h.store.getOrganization(u.ID, orgID)
+		if err == sql.ErrNoRows {
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusNotFound, "organization_not_found", ""))
+			return
+		}
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+		handle(w, r, ps, u, o)
+	})
+}
+
+func (h Handler) handleCreateOrganization() httprouter.Handle {
+	return h.requireScope(orgsWriteScope, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params, u user) {
+		requestBody := struct {
+			Name             string `json:"name"`
+			MemberPermission string `json:"member_permission"`
+		}{MemberPermission: permissionNames[permissionRead]}
+
+		if err := utils.DecodeJSON(w, r, &requestBody); err != nil {
+			utils.WriteProblem(w, r, err)
+			return
+		}
+
+		var fieldErrors utils.ValidationError
+		name := strings.TrimSpace(requestBody.Name)
+		switch length := utf8.RuneCountInString(name); {
+		case length == 0:
+			fieldErrors = append(fieldErrors, utils.FieldError{Field: "name", Message: "name can't be empty"})
+		case length > organizationNameMaxLength:
+			fieldErrors = append(fieldErrors, utils.FieldError{Field: "name", Message: fmt.Sprintf("name must be at most %d characters long", organizationNameMaxLength)})
+		}
+		permission, ok := parsePermission(requestBody.MemberPermission)
+		if !ok {
+			fieldErrors = append(fieldErrors, utils.FieldError{Field: "member_permission", Message: "must be one of read or write"})
+		}
+		if len(fieldErrors) > 0 {
+			utils.WriteProblem(w, r, fieldErrors)
+			return
+		}
+
+		o, err := h.store.createOrganization(u.ID, name, permission)
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+
+		utils.WriteJSON(w, http.StatusCreated, newOrganizationResponse(o))
+	})
+}
+
+func (h Handler) handleListOrganizations() httprouter.Handle {
+	return h.requireScope(orgsReadScope, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params, u user) {
+		orgs, err := h.store.listOrganizations(u.ID)
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+
+		response := struct {
+			Organizations []organizationResponse `json:"organizations"`
+		}{[]organizationResponse{}}
+		for _, o := range orgs {
+			response.Organizations = append(response.Organizations, newOrganizationResponse(o))
+		}
+
+		utils.WriteJSON(w, http.StatusOK, response)
+	})
+}
+
+func (h Handler) handleGetOrganization() httprouter.Handle {
+	return h.withOrganization(orgsReadScope, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params, u user, o organization) {
+		members, err := h.store.listOrganizationMembers(u.ID, o.ID)
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+
+		response := struct {
+			organizationResponse
+			Members []organizationMemberResponse `json:"members"`
+		}{newOrganizationResponse(o), []organizationMemberResponse{}}
+		for _, m := range members {
+			response.Members = append(response.Members, organizationMemberResponse(m))
+		}
+
+		utils.WriteJSON(w, http.StatusOK, response)
+	})
+}
+
+// handleSetListOrganization moves a list into an organization, whose
+// members then inherit its member permission, or back to its owner with a
+// null organization_id. The list owner or an owner or admin of the current
+// organization can move it, into organizations where they are owner or admin.
+func (h Handler) handleSetListOrganization() httprouter.Handle {
+	return h.requireScope(listsWriteScope, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params, u user) {
+		listID, ok := listIDParam(w, r, ps)
+		if !ok {
+			return
+		}
+		requestBody := struct {
+			OrganizationID *string `json:"organization_id"`
+		}{}
+
+		if err := utils.DecodeJSON(w, r, &requestBody); err != nil {
+			utils.WriteProblem(w, r, err)
+			return
+		}
+		var orgID sql.NullString
+		if requestBody.OrganizationID != nil {
+			if !uuidPattern.MatchString(*requestBody.OrganizationID) {
+				utils.WriteProblem(w, r, utils.ValidationError{{Field: "organization_id", Message: "must be an organization id or null"}})
+				return
+			}
+			orgID = sql.NullString{String: *requestBody.OrganizationID, Valid: true}
+		}
+
+		err := h.store.setListOrganization(u.ID, listID, orgID)
+		if err == sql.ErrNoRows {
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusNotFound, "list_not_found", "list doesn't exist or can't be moved to the organization"))
+			return
+		}
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+
+		response := struct {
+			ListID         string  `json:"list_id"`
+			OrganizationID *string `json:"organization_id"`
+		}{listID, requestBody.OrganizationID}
+
+		utils.WriteJSON(w, http.StatusOK, response)
+	})
+}
+
+// handleCreateOrganizationInvitation invites a user by username or email.
+// Emails that don't belong to a user yet are kept on the invitation, it is
+// offered to whoever verifies that email later on.
+func (h Handler) handleCreateOrganizationInvitation() httprouter.Handle {
+	return h.withOrganization(orgsWriteScope, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params, u user, o organization) {
+		requestBody := struct {
+			inviteeRequest
+			Role string `json:"role"`
+		}{Role: orgRoleMember}
+
+		if err := utils.DecodeJSON(w, r, &requestBody); err != nil {
+			utils.WriteProblem(w, r, err)
+			return
+		}
+		if !o.manageable() {
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusForbidden, "forbidden", "only owners and admins can invite members"))
+			return
+		}
+
+		fieldErrors := requestBody.inviteeRequest.validate()
+		if !orgRoles[requestBody.Role] {
+			fieldErrors = append(fieldErrors, utils.FieldError{Field: "role", Message: "must be one of owner, admin or member"})
+		} else if requestBody.Role == orgRoleOwner && o.Role != orgRoleOwner {
+			fieldErrors = append(fieldErrors, utils.FieldError{Field: "role", Message: "only owners can invite owners"})
+		}
+		if len(fieldErrors) > 0 {
+			utils.WriteProblem(w, r, fieldErrors)
+			return
+		}
+
+		inv := organizationInvitation{
+			OrganizationID: o.ID,
+			InvitedBy:      u.ID,
+			Role:           requestBody.Role,
+			ExpiresAt:      time.Now().Add(invitationTTL),
+		}
+		to, err := h.resolveInvitee(r, requestBody.inviteeRequest)
+		if err != nil {
+			utils.WriteProblem(w, r, err)
+			return
+		}
+		inv.InviteeUserID, inv.InviteeEmail = to.userID, to.email
+
+		inv, err = h.store.createOrganizationInvitation(u.ID, inv)
+		if err == sql.ErrNoRows {
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusNotFound, "organization_not_found", ""))
+			return
+		}
+		if err == errAlreadyMember {
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusConflict, "already_member", "user is already a member of the organization"))
+			return
+		}
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+
+		h.notifyOrganizationInvitee(r, u, inv, to)
+		utils.WriteJSON(w, http.StatusCreated, newInvitationResponse(inv))
+	})
+}
+
+func (h Handler) notifyOrganizationInvitee(r *http.Request, inviter user, inv organizationInvitation, to invitee) {
+	h.notifyInvitee(r, inv.ID, to, organizationInvitationCreatedEvent, organizationInvitationCreatedPayload{
+		InvitationID:   inv.ID,
+		OrganizationID: inv.OrganizationID,
+		InviteeUserID:  inv.InviteeUserID.String,
+		InviteeEmail:   inv.InviteeEmail.String,
+	}, mail.Message{
+		Subject: fmt.Sprintf("You've been invited to %s", inv.OrganizationName),
+		Body: fmt.Sprintf("Hi,\n\n%s invited you to join %s as %s. Sign in to accept or decline the invitation, it expires in %v.\n",
+			inviter.Username, inv.OrganizationName, inv.Role, invitationTTL),
+	})
+}
+
+// handleUpdateOrganizationMember changes the role of a member. Only owners
+// can grant or take away ownership and the last owner can't be demoted.
+func (h Handler) handleUpdateOrganizationMember() httprouter.Handle {
+	return h.withOrganization(orgsWriteScope, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params, u user, o organization) {
+		requestBody := struct {
+			Role string `json:"role"`
+		}{}
+
+		if err := utils.DecodeJSON(w, r, &requestBody); err != nil {
+			utils.WriteProblem(w, r, err)
+			return
+		}
+		if !orgRoles[requestBody.Role] {
+			utils.WriteProblem(w, r, utils.ValidationError{{Field: "role", Message: "must be one of owner, admin or member"}})
+			return
+		}
+
+		h.changeOrganizationMember(w, r, ps.ByName("userID"), u, o, requestBody.Role)
+	})
+}
+
+// handleRemoveOrganizationMember lets owners and admins remove members and
+// any member leave the organization.
+func (h Handler) handleRemoveOrganizationMember() httprouter.Handle {
+	return h.withOrganization(orgsWriteScope, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params, u user, o organization) {
+		h.changeOrganizationMember(w, r, ps.ByName("userID"), u, o, "")
+	})
+}
+
+// changeOrganizationMember sets the role of the member, or removes them when
+// role is empty.
+func (h Handler) changeOrganizationMember(w http.ResponseWriter, r *http.Request, memberID string, u user, o organization, role string) {
+	member, err := h.store.changeOrganizationMember(u.ID, o.ID, memberID, role)
+	switch {
+	case err == sql.ErrNoRows:
+		utils.WriteProblem(w, r, utils.NewProblem(http.StatusNotFound, "member_not_found", ""))
+		return
+	case err == errMemberChangeForbidden:
+		utils.WriteProblem(w, r, utils.NewProblem(http.StatusForbidden, "forbidden", "not allowed to change this member"))
+		return
+	case err == errLastOwner:
+		utils.WriteProblem(w, r, utils.NewProblem(http.StatusConflict, "last_owner", "an organization needs at least one owner"))
+		return
+	case err != nil:
+		logging.FromContext(r.Context()).Errorf("%v", err)
+		utils.WriteProblem(w, r, err)
+		return
+	}
+
+	if role == "" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, organizationMemberResponse(member))
+}
+
+// checkMemberChange returns the member userID wants to change. Owners and
+// admins manage members but only owners can grant or take away ownership,
+// anyone can leave and the last owner can't be demoted.
+func checkMemberChange(userID, memberID, role string, members []organizationMember) (organizationMember, error) {
+	var (
+		caller, member organizationMember
+		owners         int
+	)
+	for _, m := range members {
+		if m.UserID == userID {
+			caller = m
+		}
+		if m.UserID == memberID {
+			member = m
+		}
+		if m.Role == orgRoleOwner {
+			owners++
+		}
+	}
+	if caller.UserID == "" || member.UserID == "" {
+		return organizationMember{}, sql.ErrNoRows
+	}
+
+	leaving := role == "" && memberID == userID
+	manageable := caller.Role == orgRoleOwner || caller.Role == orgRoleAdmin
+	touchesOwner := member.Role == orgRoleOwner || role == orgRoleOwner
+	if !leaving && (!manageable || (touchesOwner && caller.Role != orgRoleOwner)) {
+		return organizationMember{}, errMemberChangeForbidden
+	}
+	if member.Role == orgRoleOwner && role != orgRoleOwner && owners == 1 {
+		return organizationMember{}, errLastOwner
+	}
+	return member, nil
+}
+
+func (h Handler) handleListInvitations() httprouter.Handle {
+	return h.requireScope(orgsReadScope, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params, u user) {
+		invitations, err := h.store.listInvitations(u.ID)
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+
+		response := struct {
+			Invitations []invitationResponse `json:"invitations"`
+		}{[]invitationResponse{}}
+		for _, inv := range invitations {
+			response.Invitations = append(response.Invitations, newInvitationResponse(inv))
+		}
+
+		utils.WriteJSON(w, http.StatusOK, response)
+	})
+}
+
+func (h Handler) handleRespondToInvitation(accept bool) httprouter.Handle {
+	return h.requireScope(orgsWriteScope, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params, u user) {
+		invitationID := ps.ByName("invitationID")
+		if !uuidPattern.MatchString(invitationID) {
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusNotFound, "invitation_not_found", ""))
+			return
+		}
+
+		inv, err := h.store.respondToInvitation(u.ID, invitationID, accept)
+		if err == sql.ErrNoRows {
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusNotFound, "invitation_not_found", "invitation doesn't exist, expired or was already answered"))
+			return
+		}
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+
+		utils.WriteJSON(w, http.StatusOK, newInvitationResponse(inv))
+	})
+}
+
+// errAlreadyMember is returned by the store when inviting a member of the
+// organization.
+var errAlreadyMember = errors.New("user is already a member of the organization")
+
+// errMemberChangeForbidden and errLastOwner are returned by
+// checkMemberChange.
+var (
+	errMemberChangeForbidden = errors.New("not allowed to change this member")
+	errLastOwner             = errors.New("an organization needs at least one owner")
+)
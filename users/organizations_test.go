@@ -0,0 +1,472 @@
+package users
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/lib/pq"
+)
+
+var testOrganization = organization{
+	ID:               "0b6f2a8e-9d3c-4e71-8a5f-2c4d6e8f0a1b",
+	Name:             "Acme",
+	MemberPermission: permissionRead,
+	Role:             orgRoleOwner,
+	CreatedAt:        testUser.CreatedAt,
+}
+
+var testInvitee = user{
+	ID:                 "d1e2f3a4-b5c6-4d7e-8f90-a1b2c3d4e5f6",
+	Username:           "invitee",
+	ConsumerID:         sql.NullString{String: "456", Valid: true},
+	ProvisioningStatus: userStatusActive,
+	Email:              sql.NullString{String: "invitee@example.com", Valid: true},
+	EmailVerifiedAt:    testVerifiedUser.EmailVerifiedAt,
+	CreatedAt:          testUser.CreatedAt,
+	Roles:              testUser.Roles,
+}
+
+var testUnverifiedInvitee = func() user {
+	u := testInvitee
+	u.EmailVerifiedAt = pq.NullTime{}
+	return u
+}()
+
+func organizationWithRole(role string) organization {
+	o := testOrganization
+	o.Role = role
+	return o
+}
+
+func TestCreateOrganization(t *testing.T) {
+	tests := map[string]struct {
+		requestBody  string
+		statusCode   int
+		responseBody string
+	}{
+		"returns 201 and the organization": {
+			requestBody:  `{"name":" Acme "}`,
+			statusCode:   http.StatusCreated,
+			responseBody: `{"id":"0b6f2a8e-9d3c-4e71-8a5f-2c4d6e8f0a1b","name":"Acme","member_permission":"read","role":"owner","created_at":"2018-05-01T00:00:00Z"}`,
+		},
+		"returns 400 for an invalid name and permission": {
+			requestBody:  `{"name":"","member_permission":"admin"}`,
+			statusCode:   http.StatusBadRequest,
+			responseBody: `{"type":"about:blank","title":"Bad Request","status":400,"detail":"request has invalid fields","instance":"/orgs","code":"validation_failed","errors":[{"field":"name","message":"name can't be empty"},{"field":"member_permission","message":"must be one of read or write"}]}`,
+		},
+	}
+
+	for td, tt := range tests {
+		s := testStore{}
+		s.getUserReturn.user = testUser
+		s.createOrganizationReturn.organization = testOrganization
+
+		h := NewHandler(httprouter.New(), &s, &testKongClient{}, &testSQSClient{}, &testLoginThrottle{}, &testMailer{}, nil)
+		r, _ := http.NewRequest("POST", "/orgs", bytes.NewBufferString(tt.requestBody))
+		r.Header.Set(consumerCustomIDHeader, testUser.ID)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if tt.statusCode != w.Code {
+			t.Errorf("%v: handler returned wrong status code: expected %v, got %v", td, tt.statusCode, w.Code)
+		}
+
+		if tt.responseBody != w.Body.String() {
+			t.Errorf("%v: handler returned wrong body: expected %v, got %v", td, tt.responseBody, w.Body.String())
+		}
+	}
+}
+
+func TestGetOrganization(t *testing.T) {
+	tests := map[string]struct {
+		path         string
+		storeErr     error
+		statusCode   int
+		responseBody string
+	}{
+		"returns 200 and the members": {
+			path:         "/orgs/" + testOrganization.ID,
+			statusCode:   http.StatusOK,
+			responseBody: `{"id":"0b6f2a8e-9d3c-4e71-8a5f-2c4d6e8f0a1b","name":"Acme","member_permission":"read","role":"owner","created_at":"2018-05-01T00:00:00Z","members":[{"user_id":"8c4a1b4e-0a3c-4b8f-9a51-0d5c1f3f6a11","username":"user-123","role":"owner","created_at":"2018-05-01T00:00:00Z"}]}`,
+		},
+		"returns 404 for organizations the user isn't a member of": {
+			path:         "/orgs/" + testOrganization.ID,
+			storeErr:     sql.ErrNoRows,
+			statusCode:   http.StatusNotFound,
+			responseBody: `{"type":"about:blank","title":"Not Found","status":404,"instance":"/orgs/0b6f2a8e-9d3c-4e71-8a5f-2c4d6e8f0a1b","code":"organization_not_found"}`,
+		},
+		"returns 404 when the id is not a uuid": {
+			path:         "/orgs/acme",
+			statusCode:   http.StatusNotFound,
+			responseBody: `{"type":"about:blank","title":"Not Found","status":404,"instance":"/orgs/acme","code":"organization_not_found"}`,
+		},
+	}
+
+	for td, tt := range tests {
+		s := testStore{}
+		s.getUserReturn.user = testUser
+		s.getOrganizationReturn.organization = testOrganization
+		s.getOrganizationReturn.err = tt.storeErr
+		s.listOrganizationMembersReturn.members = []organizationMember{{UserID: testUser.ID, Username: testUser.Username, Role: orgRoleOwner, CreatedAt: testUser.CreatedAt}}
+
+		h := NewHandler(httprouter.New(), &s, &testKongClient{}, &testSQSClient{}, &testLoginThrottle{}, &testMailer{}, nil)
+		r, _ := http.NewRequest("GET", tt.path, nil)
+		r.Header.Set(consumerCustomIDHeader, testUser.ID)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if tt.statusCode != w.Code {
+			t.Errorf("%v: handler returned wrong status code: expected %v, got %v", td, tt.statusCode, w.Code)
+		}
+
+		if tt.responseBody != w.Body.String() {
+			t.Errorf("%v: handler returned wrong body: expected %v, got %v", td, tt.responseBody, w.Body.String())
+		}
+	}
+}
+
+func TestCreateOrganizationInvitation(t *testing.T) {
+	tests := map[string]struct {
+		requestBody      string
+		organization     organization
+		storeInvitee     user
+		storeInviteeErr  error
+		storeInviteErr   error
+		statusCode       int
+		responseBody     string
+		inviteeUserID    string
+		inviteeEmail     string
+		sentMessages     int
+		sentEmails       int
+		expectedEmailsTo string
+	}{
+		"returns 201 and invites a user by username": {
+			requestBody:      `{"username":"Invitee"}`,
+			organization:     testOrganization,
+			storeInvitee:     testInvitee,
+			statusCode:       http.StatusCreated,
+			inviteeUserID:    testInvitee.ID,
+			sentMessages:     1,
+			sentEmails:       1,
+			expectedEmailsTo: "invitee@example.com",
+		},
+		"returns 201 and keeps the email of someone without an account": {
+			requestBody:      `{"email":"new@example.com","role":"admin"}`,
+			organization:     organizationWithRole(orgRoleAdmin),
+			storeInviteeErr:  sql.ErrNoRows,
+			statusCode:       http.StatusCreated,
+			inviteeEmail:     "new@example.com",
+			sentMessages:     1,
+			sentEmails:       1,
+			expectedEmailsTo: "new@example.com",
+		},
+		"returns 201 and keeps the email when its account hasn't verified it": {
+			requestBody:      `{"email":"invitee@example.com"}`,
+			organization:     testOrganization,
+			storeInvitee:     testUnverifiedInvitee,
+			statusCode:       http.StatusCreated,
+			inviteeEmail:     "invitee@example.com",
+			sentMessages:     1,
+			sentEmails:       1,
+			expectedEmailsTo: "invitee@example.com",
+		},
+		"returns 400 for an unknown username": {
+			requestBody:     `{"username":"nobody"}`,
+			organization:    testOrganization,
+			storeInviteeErr: sql.ErrNoRows,
+			statusCode:      http.StatusBadRequest,
+			responseBody:    `{"type":"about:blank","title":"Bad Request","status":400,"detail":"request has invalid fields","instance":"/orgs/0b6f2a8e-9d3c-4e71-8a5f-2c4d6e8f0a1b/invitations","code":"validation_failed","errors":[{"field":"username","message":"user not found"}]}`,
+		},
+		"returns 400 when admins invite owners": {
+			requestBody:  `{"username":"invitee","role":"owner"}`,
+			organization: organizationWithRole(orgRoleAdmin),
+			statusCode:   http.StatusBadRequest,
+			responseBody: `{"type":"about:blank","title":"Bad Request","status":400,"detail":"request has invalid fields","instance":"/orgs/0b6f2a8e-9d3c-4e71-8a5f-2c4d6e8f0a1b/invitations","code":"validation_failed","errors":[{"field":"role","message":"only owners can invite owners"}]}`,
+		},
+		"returns 403 for members": {
+			requestBody:  `{"username":"invitee"}`,
+			organization: organizationWithRole(orgRoleMember),
+			statusCode:   http.StatusForbidden,
+			responseBody: `{"type":"about:blank","title":"Forbidden","status":403,"detail":"only owners and admins can invite members","instance":"/orgs/0b6f2a8e-9d3c-4e71-8a5f-2c4d6e8f0a1b/invitations","code":"forbidden"}`,
+		},
+		"returns 409 when the user already is a member": {
+			requestBody:    `{"username":"invitee"}`,
+			organization:   testOrganization,
+			storeInvitee:   testInvitee,
+			storeInviteErr: errAlreadyMember,
+			statusCode:     http.StatusConflict,
+			responseBody:   `{"type":"about:blank","title":"Conflict","status":409,"detail":"user is already a member of the organization","instance":"/orgs/0b6f2a8e-9d3c-4e71-8a5f-2c4d6e8f0a1b/invitations","code":"already_member"}`,
+			inviteeUserID:  testInvitee.ID,
+		},
+	}
+
+	for td, tt := range tests {
+		s := testStore{}
+		s.getUserReturn.user = testUser
+		s.getOrganizationReturn.organization = tt.organization
+		s.getUserByUsernameReturn.user = tt.storeInvitee
+		s.getUserByUsernameReturn.err = tt.storeInviteeErr
+		s.getUserByEmailReturn.user = tt.storeInvitee
+		s.getUserByEmailReturn.err = tt.storeInviteeErr
+		s.createOrganizationInvitationReturn.err = tt.storeInviteErr
+		s.createOrganizationInvitationReturn.invitation = organizationInvitation{
+			ID:               "9a8b7c6d-5e4f-4a3b-2c1d-0e9f8a7b6c5d",
+			OrganizationID:   testOrganization.ID,
+			OrganizationName: testOrganization.Name,
+			InviteeEmail:     sql.NullString{String: tt.inviteeEmail, Valid: tt.inviteeEmail != ""},
+			InviteeUserID:    sql.NullString{String: tt.inviteeUserID, Valid: tt.inviteeUserID != ""},
+			Role:             orgRoleMember,
+			Status:           invitationStatusPending,
+			ExpiresAt:        time.Now().Add(time.Hour),
+		}
+		sqsClient := testSQSClient{}
+		mailer := testMailer{}
+
+		h := NewHandler(httprouter.New(), &s, &testKongClient{}, &sqsClient, &testLoginThrottle{}, &mailer, nil)
+		r, _ := http.NewRequest("POST", "/orgs/"+testOrganization.ID+"/invitations", bytes.NewBufferString(tt.requestBody))
+		r.Header.Set(consumerCustomIDHeader, testUser.ID)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if tt.statusCode != w.Code {
+			t.Errorf("%v: handler returned wrong status code: expected %v, got %v", td, tt.statusCode, w.Code)
+		}
+
+		if tt.responseBody != "" && tt.responseBody != w.Body.String() {
+			t.Errorf("%v: handler returned wrong body: expected %v, got %v", td, tt.responseBody, w.Body.String())
+		}
+
+		if tt.inviteeUserID != "" || tt.inviteeEmail != "" {
+			if len(s.createdInvitations) != 1 {
+				t.Errorf("%v: expected an invitation to be created, got %v", td, len(s.createdInvitations))
+			} else if inv := s.createdInvitations[0]; inv.InviteeUserID.String != tt.inviteeUserID || inv.InviteeEmail.String != tt.inviteeEmail {
+				t.Errorf("%v: invitation has wrong invitee: %+v", td, inv)
+			}
+		}
+
+		if len(sqsClient.sentMessages) != tt.sentMessages {
+			t.Errorf("%v: wrong number of events: expected %v, got %v", td, tt.sentMessages, len(sqsClient.sentMessages))
+		}
+
+		if len(mailer.sent) != tt.sentEmails {
+			t.Errorf("%v: wrong number of emails: expected %v, got %v", td, tt.sentEmails, len(mailer.sent))
+		} else if tt.sentEmails > 0 && mailer.sent[0].To != tt.expectedEmailsTo {
+			t.Errorf("%v: email sent to wrong address: expected %v, got %v", td, tt.expectedEmailsTo, mailer.sent[0].To)
+		}
+	}
+}
+
+func TestChangeOrganizationMember(t *testing.T) {
+	owner := organizationMember{UserID: testUser.ID, Username: testUser.Username, Role: orgRoleOwner, CreatedAt: testUser.CreatedAt}
+	member := organizationMember{UserID: testInvitee.ID, Username: testInvitee.Username, Role: orgRoleMember, CreatedAt: testUser.CreatedAt}
+	otherOwner := organizationMember{UserID: "7e6d5c4b-3a29-4180-9f7e-6d5c4b3a2918", Username: "other", Role: orgRoleOwner, CreatedAt: testUser.CreatedAt}
+
+	tests := map[string]struct {
+		method            string
+		memberID          string
+		requestBody       string
+		organization      organization
+		statusCode        int
+		responseBody      string
+		soleOwner         bool
+		memberRoleChanges int
+		removedMembers    int
+	}{
+		"returns 200 and promotes a member": {
+			method:            "PATCH",
+			memberID:          member.UserID,
+			requestBody:       `{"role":"admin"}`,
+			organization:      testOrganization,
+			statusCode:        http.StatusOK,
+			responseBody:      fmt.Sprintf(`{"user_id":"%v","username":"invitee","role":"admin","created_at":"2018-05-01T00:00:00Z"}`, member.UserID),
+			memberRoleChanges: 1,
+		},
+		"returns 403 when admins demote owners": {
+			method:       "PATCH",
+			memberID:     otherOwner.UserID,
+			requestBody:  `{"role":"member"}`,
+			organization: organizationWithRole(orgRoleAdmin),
+			statusCode:   http.StatusForbidden,
+		},
+		"returns 409 when demoting the last owner": {
+			method:       "PATCH",
+			memberID:     owner.UserID,
+			requestBody:  `{"role":"member"}`,
+			organization: testOrganization,
+			soleOwner:    true,
+			statusCode:   http.StatusConflict,
+			responseBody: fmt.Sprintf(`{"type":"about:blank","title":"Conflict","status":409,"detail":"an organization needs at least one owner","instance":"/orgs/%v/members/%v","code":"last_owner"}`, testOrganization.ID, owner.UserID),
+		},
+		"returns 404 for someone who isn't a member": {
+			method:       "DELETE",
+			memberID:     "5f0e7d4c-3b2a-4c19-8e07-6d5c4b3a2f10",
+			organization: testOrganization,
+			statusCode:   http.StatusNotFound,
+		},
+		"returns 403 when members remove others": {
+			method:       "DELETE",
+			memberID:     member.UserID,
+			organization: organizationWithRole(orgRoleMember),
+			statusCode:   http.StatusForbidden,
+		},
+		"returns 204 when an owner leaves while another remains": {
+			method:         "DELETE",
+			memberID:       owner.UserID,
+			organization:   testOrganization,
+			statusCode:     http.StatusNoContent,
+			removedMembers: 1,
+		},
+		"returns 204 and removes a member": {
+			method:         "DELETE",
+			memberID:       member.UserID,
+			organization:   organizationWithRole(orgRoleAdmin),
+			statusCode:     http.StatusNoContent,
+			removedMembers: 1,
+		},
+	}
+
+	for td, tt := range tests {
+		s := testStore{}
+		s.getUserReturn.user = testUser
+		s.getOrganizationReturn.organization = tt.organization
+		caller := owner
+		caller.Role = tt.organization.Role
+		s.listOrganizationMembersReturn.members = []organizationMember{caller, member, otherOwner}
+		if tt.soleOwner {
+			s.listOrganizationMembersReturn.members = []organizationMember{caller, member}
+		}
+
+		h := NewHandler(httprouter.New(), &s, &testKongClient{}, &testSQSClient{}, &testLoginThrottle{}, &testMailer{}, nil)
+		r, _ := http.NewRequest(tt.method, "/orgs/"+testOrganization.ID+"/members/"+tt.memberID, bytes.NewBufferString(tt.requestBody))
+		r.Header.Set(consumerCustomIDHeader, testUser.ID)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if tt.statusCode != w.Code {
+			t.Errorf("%v: handler returned wrong status code: expected %v, got %v", td, tt.statusCode, w.Code)
+		}
+
+		if tt.responseBody != "" && tt.responseBody != w.Body.String() {
+			t.Errorf("%v: handler returned wrong body: expected %v, got %v", td, tt.responseBody, w.Body.String())
+		}
+
+		if len(s.memberRoleChanges) != tt.memberRoleChanges {
+			t.Errorf("%v: wrong number of role changes: expected %v, got %v", td, tt.memberRoleChanges, len(s.memberRoleChanges))
+		}
+
+		if len(s.removedMembers) != tt.removedMembers {
+			t.Errorf("%v: wrong number of removed members: expected %v, got %v", td, tt.removedMembers, len(s.removedMembers))
+		}
+	}
+}
+
+func TestRespondToInvitation(t *testing.T) {
+	invitationID := "9a8b7c6d-5e4f-4a3b-2c1d-0e9f8a7b6c5d"
+	tests := map[string]struct {
+		path       string
+		storeErr   error
+		statusCode int
+		answers    []bool
+	}{
+		"returns 200 when accepting": {
+			path:       "/users/me/invitations/" + invitationID + "/accept",
+			statusCode: http.StatusOK,
+			answers:    []bool{true},
+		},
+		"returns 200 when declining": {
+			path:       "/users/me/invitations/" + invitationID + "/decline",
+			statusCode: http.StatusOK,
+			answers:    []bool{false},
+		},
+		"returns 404 for invitations that can't be answered": {
+			path:       "/users/me/invitations/" + invitationID + "/accept",
+			storeErr:   sql.ErrNoRows,
+			statusCode: http.StatusNotFound,
+			answers:    []bool{true},
+		},
+	}
+
+	for td, tt := range tests {
+		s := testStore{}
+		s.getUserReturn.user = testUser
+		s.respondToInvitationReturn.err = tt.storeErr
+
+		h := NewHandler(httprouter.New(), &s, &testKongClient{}, &testSQSClient{}, &testLoginThrottle{}, &testMailer{}, nil)
+		r, _ := http.NewRequest("POST", tt.path, nil)
+		r.Header.Set(consumerCustomIDHeader, testUser.ID)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if tt.statusCode != w.Code {
+			t.Errorf("%v: handler returned wrong status code: expected %v, got %v", td, tt.statusCode, w.Code)
+		}
+
+		if fmt.Sprint(s.invitationAnswers) != fmt.Sprint(tt.answers) {
+			t.Errorf("%v: wrong answers: expected %v, got %v", td, tt.answers, s.invitationAnswers)
+		}
+	}
+}
+
+func TestSetListOrganization(t *testing.T) {
+	tests := map[string]struct {
+		requestBody    string
+		storeErr       error
+		statusCode     int
+		responseBody   string
+		organizationID sql.NullString
+	}{
+		"returns 200 and moves the list into the organization": {
+			requestBody:    fmt.Sprintf(`{"organization_id":"%v"}`, testOrganization.ID),
+			statusCode:     http.StatusOK,
+			responseBody:   fmt.Sprintf(`{"list_id":"%v","organization_id":"%v"}`, testListID, testOrganization.ID),
+			organizationID: sql.NullString{String: testOrganization.ID, Valid: true},
+		},
+		"returns 200 and gives the list back to its owner": {
+			requestBody:  `{"organization_id":null}`,
+			statusCode:   http.StatusOK,
+			responseBody: fmt.Sprintf(`{"list_id":"%v","organization_id":null}`, testListID),
+		},
+		"returns 400 for a malformed organization id": {
+			requestBody:  `{"organization_id":"acme"}`,
+			statusCode:   http.StatusBadRequest,
+			responseBody: fmt.Sprintf(`{"type":"about:blank","title":"Bad Request","status":400,"detail":"request has invalid fields","instance":"/lists/%v/organization","code":"validation_failed","errors":[{"field":"organization_id","message":"must be an organization id or null"}]}`, testListID),
+		},
+		"returns 404 when the user can't move the list there": {
+			requestBody:    fmt.Sprintf(`{"organization_id":"%v"}`, testOrganization.ID),
+			storeErr:       sql.ErrNoRows,
+			statusCode:     http.StatusNotFound,
+			responseBody:   fmt.Sprintf(`{"type":"about:blank","title":"Not Found","status":404,"detail":"list doesn't exist or can't be moved to the organization","instance":"/lists/%v/organization","code":"list_not_found"}`, testListID),
+			organizationID: sql.NullString{String: testOrganization.ID, Valid: true},
+		},
+	}
+
+	for td, tt := range tests {
+		s := testStore{}
+		s.getUserReturn.user = testUser
+		s.setListOrganizationReturn.err = tt.storeErr
+
+		h := NewHandler(httprouter.New(), &s, &testKongClient{}, &testSQSClient{}, &testLoginThrottle{}, &testMailer{}, nil)
+		r, _ := http.NewRequest("PUT", "/lists/"+testListID+"/organization", bytes.NewBufferString(tt.requestBody))
+		r.Header.Set(consumerCustomIDHeader, testUser.ID)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if tt.statusCode != w.Code {
+			t.Errorf("%v: handler returned wrong status code: expected %v, got %v", td, tt.statusCode, w.Code)
+		}
+
+		if tt.responseBody != w.Body.String() {
+			t.Errorf("%v: handler returned wrong body: expected %v, got %v", td, tt.responseBody, w.Body.String())
+		}
+
+		if tt.statusCode != http.StatusBadRequest && (len(s.movedLists) != 1 || s.movedLists[0] != tt.organizationID) {
+			t.Errorf("%v: expected the list to be moved to %v, got %v", td, tt.organizationID, s.movedLists)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package users
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/diorman/todospoc/logging"
+	"github.com/diorman/todospoc/metrics"
+)
+
+const (
+	// provisioningGracePeriod leaves recently created users to the worker
+	// so that the reconciler doesn't race with it.
+	provisioningGracePeriod = 5 * time.Minute
+	reconcilerPageSize      = 500
+
+	// reconcilerLockKey is the advisory lock that lets only one worker
+	// replica reconcile at a time.
+	reconcilerLockKey int64 = 7203461
+)
+
+const (
+	issueUserWithoutConsumer = "user_without_consumer"
+	issueUserConsumerMissing = "user_consumer_missing"
+	issueConsumerNotLinked   = "consumer_not_linked"
+	issueOrphanConsumer      = "orphan_consumer"
+	issueConsumerWithoutJWT  = "consumer_without_jwt"
+)
+
+type ReconcileIssue struct {
+	Kind       string `json:"kind"`
+	UserID     string `json:"user_id,omitempty"`
+	ConsumerID string `json:"consumer_id,omitempty"`
+	Repaired   bool   `json:"repaired"`
+	Error      string `json:"error,omitempty"`
+}
+
+type ReconcileReport struct {
+	DryRun    bool             `json:"dry_run"`
+	Skipped   bool             `json:"skipped,omitempty"`
+	Users     int              `json:"users"`
+	Consumers int              `json:"consumers"`
+	Issues    []ReconcileIssue `json:"issues"`
+}
+
+// Reconciler compares the users table against the Kong consumers and repairs
+// what the worker could not: users left without a consumer, consumers that
+// point to no user and consumers without JWT credentials. In dry run mode the
+// issues are only reported.
+type Reconciler struct {
+	store  Store
+	kong   KongClient
+	dryRun bool
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func NewReconciler(s Store, k KongClient, dryRun bool) *Reconciler {
+	return &Reconciler{
+		store:  s,
+		kong:   k,
+		dryRun: dryRun,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Start runs the reconciler right away and then every interval until Stop is
+// called.
+func (rc *Reconciler) Start(interval time.Duration) {
+	defer close(rc.done)
+	logger := logging.Default().With(logging.Fields{"component": "reconciler"})
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		rc.runAndLog(logger)
+		select {
+		case <-rc.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (rc *Reconciler) runAndLog(logger *logging.Logger) {
+	report, err := rc.Run()
+	if err != nil {
+		logger.Errorf("reconciliation failed: %v", err)
+		return
+	}
+	if report.Skipped {
+		logger.Infof("skipped reconciliation, another replica is running it")
+		return
+	}
+	for _, issue := range report.Issues {
+		logger.With(logging.Fields{
+			"kind":        issue.Kind,
+			"user_id":     issue.UserID,
+			"consumer_id": issue.ConsumerID,
+			"repaired":    issue.Repaired,
+			"error":       issue.Error,
+		}).Warnf("reconciliation issue")
+	}
+	logger.Infof("reconciled %d users and %d consumers, found %d issues", report.Users, report.Consumers, len(report.Issues))
+}
+
+func (rc *Reconciler) Stop() {
+	close(rc.stop)
+	<-rc.done
+}
+
+// Run reconciles once, or reports it skipped when another replica holds the
+// reconciler lock.
+func (rc *Reconciler) Run() (ReconcileReport, error) {
+	var report ReconcileReport
+	locked, err := rc.store.tryAdvisoryLock(reconcilerLockKey, func() error {
+		var err error
+		report, err = rc.run()
+		return err
+	})
+	if err != nil {
+		return report, err
+	}
+	if !locked {
+		return ReconcileReport{DryRun: rc.dryRun, Skipped: true, Issues: []ReconcileIssue{}}, nil
+	}
+	return report, nil
+}
+
+func (rc *Reconciler) run() (ReconcileReport, error) {
+	report := ReconcileReport{DryRun: rc.dryRun, Issues: []ReconcileIssue{}}
+
+	// consumers are listed first so that a user created in between is
+	// listed along with its consumer or not seen at all
+	consumers, err := rc.kong.listConsumers()
+	if err != nil {
+		return report, fmt.Errorf("could not list Kong consumers: %v", err)
+	}
+	users, err := rc.listAllUsers()
+	if err != nil {
+		return report, fmt.Errorf("could not list users: %v", err)
+	}
+	report.Users, report.Consumers = len(users), len(consumers)
+
+	var (
+		usersByID       = make(map[string]user, len(users))
+		consumersByID   = make(map[string]KongConsumer, len(consumers))
+		linkedConsumers = map[string]bool{}
+	)
+	for _, u := range users {
+		usersByID[u.ID] = u
+	}
+	for _, c := range consumers {
+		consumersByID[c.ID] = c
+	}
+
+	for _, c := range consumers {
+		// consumers without a user id, like the anonymous one, or of other
+		// services are not ours to reconcile
+		if !uuidPattern.MatchString(c.CustomID) {
+			continue
+		}
+		u, ok := usersByID[c.CustomID]
+		switch {
+		case !ok && !c.createdBefore(provisioningGracePeriod):
+			// the user may have been created after the listing
+		case !ok:
+			report.add(rc.repair(ReconcileIssue{Kind: issueOrphanConsumer, ConsumerID: c.ID}, func() error {
+				return rc.kong.deleteConsumer(c.ID)
+			}))
+		case !u.ConsumerID.Valid:
+			// the worker created the consumer but failed to store its id
+			linkedConsumers[u.ID] = true
+			report.add(rc.repair(ReconcileIssue{Kind: issueConsumerNotLinked, UserID: u.ID, ConsumerID: c.ID}, func() error {
+				return rc.store.setConsumerID(u.ID, c.ID)
+			}))
+		case u.ConsumerID.String != c.ID:
+			report.add(rc.repair(ReconcileIssue{Kind: issueOrphanConsumer, UserID: u.ID, ConsumerID: c.ID}, func() error {
+				return rc.kong.deleteConsumer(c.ID)
+			}))
+		case !u.DisabledAt.Valid:
+			credentials, err := rc.kong.getJWTCredentials(c.ID)
+			if err != nil {
+				return report, err
+			}
+			if len(credentials) == 0 {
+				report.add(rc.repair(ReconcileIssue{Kind: issueConsumerWithoutJWT, UserID: u.ID, ConsumerID: c.ID}, func() error {
+					return rc.kong.createJWTCredentials(c.ID)
+				}))
+			}
+		}
+	}
+
+	for _, u := range users {
+		if u.DisabledAt.Valid || u.awaitingVerification() || linkedConsumers[u.ID] {
+			continue
+		}
+		if u.ConsumerID.Valid {
+			if _, ok := consumersByID[u.ConsumerID.String]; !ok {
+				report.add(rc.repair(ReconcileIssue{Kind: issueUserConsumerMissing, UserID: u.ID, ConsumerID: u.ConsumerID.String}, func() error {
+					if err := rc.store.clearConsumerID(u.ID); err != nil {
+						return err
+					}
+					// API keys were key-auth credentials of the missing consumer
+					if err := rc.store.revokeAPIKeys(u.ID); err != nil {
+						return err
+					}
+					return provisionConsumer(rc.store, rc.kong, u.ID)
+				}))
+			}
+			continue
+		}
+		if time.Since(u.CreatedAt) > provisioningGracePeriod {
+			report.add(rc.repair(ReconcileIssue{Kind: issueUserWithoutConsumer, UserID: u.ID}, func() error {
+				return provisionConsumer(rc.store, rc.kong, u.ID)
+			}))
+		}
+	}
+
+	issuesByKind := map[string]int{}
+	for _, issue := range report.Issues {
+		issuesByKind[issue.Kind]++
+	}
+	for _, kind := range []string{issueUserWithoutConsumer, issueUserConsumerMissing, issueConsumerNotLinked, issueOrphanConsumer, issueConsumerWithoutJWT} {
+		metrics.ReconcilerIssues.WithLabelValues(kind).Set(float64(issuesByKind[kind]))
+	}
+
+	return report, nil
+}
+
+func (rc *Reconciler) repair(issue ReconcileIssue, fix func() error) ReconcileIssue {
+	if rc.dryRun {
+		return issue
+	}
+	if err := fix(); err != nil {
+		issue.Error = err.Error()
+		return issue
+	}
+	issue.Repaired = true
+	return issue
+}
+
+func (report *ReconcileReport) add(issue ReconcileIssue) {
+	report.Issues = append(report.Issues, issue)
+}
+
+func (rc *Reconciler) listAllUsers() ([]user, error) {
+	var (
+		all   []user
+		after string
+	)
+	for {
+		page, err := rc.store.listUsers(userFilter{After: after, Limit: reconcilerPageSize})
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, page...)
+		if len(page) < reconcilerPageSize {
+			return all, nil
+		}
+		after = page[len(page)-1].Username
+	}
+}
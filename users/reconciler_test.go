@@ -0,0 +1,104 @@
+package users
+
+import (
+	"database/sql"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestReconcilerRun(t *testing.T) {
+	const (
+		u1 = "00000000-0000-4000-8000-000000000001"
+		u2 = "00000000-0000-4000-8000-000000000002"
+		u3 = "00000000-0000-4000-8000-000000000003"
+		u4 = "00000000-0000-4000-8000-000000000004"
+		u5 = "00000000-0000-4000-8000-000000000005"
+		u6 = "00000000-0000-4000-8000-000000000006"
+		// u8 signs up after the users are listed
+		u8 = "00000000-0000-4000-8000-000000000008"
+		// deleted has no user anymore
+		deleted = "00000000-0000-4000-8000-000000000009"
+	)
+	var (
+		old   = time.Now().Add(-time.Hour)
+		oldMs = old.UnixNano() / int64(time.Millisecond)
+		nowMs = time.Now().UnixNano() / int64(time.Millisecond)
+		users = []user{
+			{ID: u1, Username: "active", ConsumerID: sql.NullString{String: "c1", Valid: true}, CreatedAt: old},
+			{ID: u2, Username: "pending", CreatedAt: old},
+			{ID: u3, Username: "recent", CreatedAt: time.Now()},
+			{ID: u4, Username: "dangling", ConsumerID: sql.NullString{String: "gone", Valid: true}, CreatedAt: old},
+			{ID: u5, Username: "unlinked", CreatedAt: old},
+			{ID: u6, Username: "disabled", ConsumerID: sql.NullString{String: "c6", Valid: true}, CreatedAt: old, DisabledAt: pq.NullTime{Time: old, Valid: true}},
+		}
+		consumers = []KongConsumer{
+			{ID: "c1", CustomID: u1, CreatedAt: oldMs},
+			{ID: "c5", CustomID: u5, CreatedAt: oldMs},
+			{ID: "c6", CustomID: u6, CreatedAt: oldMs},
+			{ID: "c7", CustomID: deleted, CreatedAt: oldMs},
+			{ID: "c8", CustomID: u8, CreatedAt: nowMs},
+			{ID: "anonymous", CreatedAt: oldMs},
+			{ID: "other-service", CustomID: "billing", CreatedAt: oldMs},
+		}
+		expected = []string{
+			issueConsumerNotLinked + " " + u5 + " c5",
+			issueConsumerWithoutJWT + " " + u1 + " c1",
+			issueOrphanConsumer + "  c7",
+			issueUserConsumerMissing + " " + u4 + " gone",
+			issueUserWithoutConsumer + " " + u2 + " ",
+		}
+	)
+
+	for _, dryRun := range []bool{true, false} {
+		s := testStore{}
+		s.listUsersReturn.users = users
+		k := testKongClient{}
+		k.listConsumersReturn.consumers = consumers
+
+		report, err := NewReconciler(&s, &k, dryRun).Run()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		var issues []string
+		for _, issue := range report.Issues {
+			issues = append(issues, issue.Kind+" "+issue.UserID+" "+issue.ConsumerID)
+			if issue.Repaired == dryRun {
+				t.Errorf("dry run %v: unexpected repaired flag for %+v", dryRun, issue)
+			}
+		}
+		sort.Strings(issues)
+		if len(issues) != len(expected) {
+			t.Fatalf("dry run %v: unexpected issues: %v", dryRun, issues)
+		}
+		for i := range expected {
+			if issues[i] != expected[i] {
+				t.Errorf("dry run %v: expected issue %q, got %q", dryRun, expected[i], issues[i])
+			}
+		}
+
+		if !dryRun && (len(s.revokedUserAPIKeys) != 1 || s.revokedUserAPIKeys[0] != u4) {
+			t.Errorf("expected the api keys of the user with a missing consumer to be revoked, got %v", s.revokedUserAPIKeys)
+		}
+		if !dryRun && (len(k.deletedConsumers) != 1 || k.deletedConsumers[0] != "c7") {
+			t.Errorf("expected only the orphan consumer to be deleted, got %v", k.deletedConsumers)
+		}
+	}
+}
+
+func TestReconcilerRunSkipsWhenLocked(t *testing.T) {
+	s := testStore{advisoryLockHeld: true}
+	k := testKongClient{}
+	k.listConsumersReturn.consumers = []KongConsumer{{ID: "c7", CustomID: "00000000-0000-4000-8000-000000000009"}}
+
+	report, err := NewReconciler(&s, &k, false).Run()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !report.Skipped || len(report.Issues) != 0 || len(k.deletedConsumers) != 0 {
+		t.Errorf("expected the run to be skipped while another replica holds the lock, got %+v", report)
+	}
+}
@@ -0,0 +1,241 @@
+package users
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/diorman/todospoc"
+	"github.com/diorman/todospoc/logging"
+	"github.com/diorman/todospoc/utils"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// The roles are the values of the user_roles table, every user gets the user
+// role on signup.
+const (
+	roleUser    = "user"
+	roleSupport = "support"
+	roleAdmin   = "admin"
+
+	// apiKeyHeader is where clients send API keys, the default key name of
+	// the Kong key-auth plugin.
+	apiKeyHeader = "apikey"
+
+	// apiKeysManageScope can't be delegated to API keys, managing them takes
+	// a JWT.
+	apiKeysManageScope = "api_keys:manage"
+)
+
+var roleScopes = map[string][]string{
+	roleUser:    {apiKeysManageScope, listsReadScope, listsWriteScope, orgsReadScope, orgsWriteScope, "todos:read", "todos:write"},
+	roleSupport: {"users:read"},
+	roleAdmin:   {"users:read", "users:write"},
+}
+
+// tokenClaims are embedded in the JWTs minted on login so services behind
+// Kong can authorize requests without calling back.
+type tokenClaims struct {
+	Subject string   `json:"sub"`
+	Roles   []string `json:"roles"`
+	Scope   string   `json:"scope"`
+}
+
+func newTokenClaims(u user) tokenClaims {
+	return tokenClaims{
+		Subject: u.ID,
+		Roles:   append([]string{}, u.Roles...),
+		Scope:   strings.Join(scopesForRoles(u.Roles), " "),
+	}
+}
+
+func scopesForRoles(roles []string) []string {
+	scopes := []string{}
+	for _, role := range roles {
+		scopes = append(scopes, roleScopes[role]...)
+	}
+	return uniqueSorted(scopes)
+}
+
+// aclGroup is the Kong ACL group mirroring role, admins are kept in the
+// configured admin group the /admin route whitelists.
+func aclGroup(role string) string {
+	if role == roleAdmin {
+		return todospoc.Config.AdminACLGroup
+	}
+	return role
+}
+
+// syncACLGroups makes the ACL groups of the consumer match roles, groups
+// Kong has that don't belong to a role are left alone.
+func syncACLGroups(kong KongClient, consumerID string, roles []string) error {
+	acls, err := kong.listACLGroups(consumerID)
+	if err != nil {
+		return err
+	}
+
+	wanted := map[string]bool{}
+	for _, role := range roles {
+		wanted[aclGroup(role)] = true
+	}
+	for role := range roleScopes {
+		group := aclGroup(role)
+		for _, acl := range acls {
+			if acl.Group != group {
+				continue
+			}
+			if wanted[group] {
+				delete(wanted, group)
+			} else if err := kong.deleteACLGroup(consumerID, acl.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	groups := []string{}
+	for group := range wanted {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	for _, group := range groups {
+		if err := kong.addACLGroup(consumerID, group); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requestScopes are the scopes of the signed in user's roles, narrowed down
+// to the scopes of the API key when the request was authenticated with one.
+func (h Handler) requestScopes(r *http.Request, u user) (map[string]bool, error) {
+	scopes := map[string]bool{}
+	for _, scope := range scopesForRoles(u.Roles) {
+		scopes[scope] = true
+	}
+
+	key := r.Header.Get(apiKeyHeader)
+	if key == "" {
+		key = r.URL.Query().Get(apiKeyHeader)
+	}
+	if key == "" {
+		return scopes, nil
+	}
+
+	k, err := h.store.getAPIKeyByHash(hashToken(key))
+	if err == sql.ErrNoRows || (err == nil && k.UserID != u.ID) {
+		return map[string]bool{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	keyScopes := map[string]bool{}
+	for _, scope := range k.Scopes {
+		if scopes[scope] {
+			keyScopes[scope] = true
+		}
+	}
+	return keyScopes, nil
+}
+
+// requireScope only lets signed in users whose request carries scope through.
+func (h Handler) requireScope(scope string, handle func(http.ResponseWriter, *http.Request, httprouter.Params, user)) httprouter.Handle {
+	return h.withSignedInUser(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params, u user) {
+		scopes, err := h.requestScopes(r, u)
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+		if !scopes[scope] {
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusForbidden, "insufficient_scope", fmt.Sprintf("the %s scope is required", scope)))
+			return
+		}
+		handle(w, r, ps, u)
+	})
+}
+
+// handleGetSignedInUser tells clients what the credentials they hold allow.
+func (h Handler) handleGetSignedInUser() httprouter.Handle {
+	return h.withSignedInUser(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params, u user) {
+		scopes, err := h.requestScopes(r, u)
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+
+		response := struct {
+			ID            string   `json:"id"`
+			Username      string   `json:"username"`
+			EmailVerified *bool    `json:"email_verified,omitempty"`
+			Roles         []string `json:"roles"`
+			Scopes        []string `json:"scopes"`
+		}{ID: u.ID, Username: u.Username, Roles: append([]string{}, u.Roles...), Scopes: []string{}}
+		if u.Email.Valid {
+			verified := u.EmailVerifiedAt.Valid
+			response.EmailVerified = &verified
+		}
+		for scope := range scopes {
+			response.Scopes = append(response.Scopes, scope)
+		}
+		sort.Strings(response.Scopes)
+
+		utils.WriteJSON(w, http.StatusOK, response)
+	})
+}
+
+func validateRoles(roles []string) error {
+	var fieldErrors utils.ValidationError
+	if len(roles) == 0 {
+		fieldErrors = append(fieldErrors, utils.FieldError{Field: "roles", Message: "at least one role is required"})
+	}
+	for _, role := range roles {
+		if _, ok := roleScopes[role]; !ok {
+			fieldErrors = append(fieldErrors, utils.FieldError{Field: "roles", Message: fmt.Sprintf("unknown role %q", role)})
+		}
+	}
+	if len(fieldErrors) > 0 {
+		return fieldErrors
+	}
+	return nil
+}
+
+// handleAdminSetRoles replaces the roles of a user and mirrors them into the
+// ACL groups of their consumer. Tokens minted before keep their claims.
+func (h Handler) handleAdminSetRoles() httprouter.Handle {
+	return h.withUser(func(w http.ResponseWriter, r *http.Request, u user) {
+		requestBody := struct {
+			Roles []string `json:"roles"`
+		}{}
+
+		if err := utils.DecodeJSON(w, r, &requestBody); err != nil {
+			utils.WriteProblem(w, r, err)
+			return
+		}
+		roles := uniqueSorted(requestBody.Roles)
+		if err := validateRoles(roles); err != nil {
+			utils.WriteProblem(w, r, err)
+			return
+		}
+
+		if err := h.store.setRoles(u.ID, roles); err != nil {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+		u.Roles = roles
+		logging.FromContext(r.Context()).With(logging.Fields{"user_id": u.ID, "roles": roles}).Infof("user roles changed")
+
+		if u.ConsumerID.Valid {
+			if err := syncACLGroups(h.kong, u.ConsumerID.String, roles); err != nil {
+				writeKongProblem(w, r, err)
+				return
+			}
+		}
+
+		utils.WriteJSON(w, http.StatusOK, newAdminUserResponse(u))
+	})
+}
@@ -0,0 +1,199 @@
+package users
+
+import (
+	"bytes"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestSyncACLGroups(t *testing.T) {
+	k := testKongClient{}
+	k.listACLGroupsReturn.acls = []KongACL{
+		{ID: "acl-user", Group: "user"},
+		{ID: "acl-support", Group: "support"},
+		{ID: "acl-other", Group: "beta-testers"},
+	}
+
+	if err := syncACLGroups(&k, "123", []string{roleAdmin, roleUser}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !reflect.DeepEqual(k.addedACLGroups, []string{"admin"}) {
+		t.Errorf("wrong added groups: expected %v, got %v", []string{"admin"}, k.addedACLGroups)
+	}
+	if !reflect.DeepEqual(k.deletedACLGroups, []string{"acl-support"}) {
+		t.Errorf("wrong deleted groups: expected %v, got %v", []string{"acl-support"}, k.deletedACLGroups)
+	}
+}
+
+func TestGetSignedInUser(t *testing.T) {
+	tests := map[string]struct {
+		user         user
+		apiKey       string
+		storeAPIKey  apiKey
+		storeErr     error
+		statusCode   int
+		responseBody string
+	}{
+		"returns the scopes of the roles for a jwt": {
+			user:         testUser,
+			statusCode:   http.StatusOK,
+			responseBody: `{"id":"8c4a1b4e-0a3c-4b8f-9a51-0d5c1f3f6a11","username":"user-123","roles":["user"],"scopes":["api_keys:manage","lists:read","lists:write","orgs:read","orgs:write","todos:read","todos:write"]}`,
+		},
+		"returns whether the email is verified": {
+			user:         testVerifiedUser,
+			statusCode:   http.StatusOK,
+			responseBody: `{"id":"8c4a1b4e-0a3c-4b8f-9a51-0d5c1f3f6a11","username":"user-123","email_verified":true,"roles":["user"],"scopes":["api_keys:manage","lists:read","lists:write","orgs:read","orgs:write","todos:read","todos:write"]}`,
+		},
+		"returns the scopes of the api key": {
+			user:         testUser,
+			apiKey:       "tdp_secret",
+			storeAPIKey:  testAPIKey,
+			statusCode:   http.StatusOK,
+			responseBody: `{"id":"8c4a1b4e-0a3c-4b8f-9a51-0d5c1f3f6a11","username":"user-123","roles":["user"],"scopes":["todos:read"]}`,
+		},
+		"returns no scopes for an unknown api key": {
+			user:         testUser,
+			apiKey:       "tdp_secret",
+			storeErr:     sql.ErrNoRows,
+			statusCode:   http.StatusOK,
+			responseBody: `{"id":"8c4a1b4e-0a3c-4b8f-9a51-0d5c1f3f6a11","username":"user-123","roles":["user"],"scopes":[]}`,
+		},
+	}
+
+	for td, tt := range tests {
+		s := testStore{}
+		s.getUserReturn.user = tt.user
+		s.getAPIKeyByHashReturn.apiKey = tt.storeAPIKey
+		s.getAPIKeyByHashReturn.err = tt.storeErr
+
+		h := NewHandler(httprouter.New(), &s, &testKongClient{}, &testSQSClient{}, &testLoginThrottle{}, &testMailer{}, nil)
+		r, _ := http.NewRequest("GET", "/users/me", nil)
+		r.Header.Set(consumerCustomIDHeader, testUser.ID)
+		if tt.apiKey != "" {
+			r.Header.Set(apiKeyHeader, tt.apiKey)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if tt.statusCode != w.Code {
+			t.Errorf("%v: handler returned wrong status code: expected %v, got %v", td, tt.statusCode, w.Code)
+		}
+
+		if tt.responseBody != w.Body.String() {
+			t.Errorf("%v: handler returned wrong body: expected %v, got %v", td, tt.responseBody, w.Body.String())
+		}
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	supportUser := testUser
+	supportUser.Roles = []string{roleSupport}
+
+	tests := map[string]struct {
+		storeUser    user
+		apiKey       string
+		statusCode   int
+		responseBody string
+	}{
+		"lets a user with the scope through": {
+			storeUser:  testUser,
+			statusCode: http.StatusOK,
+		},
+		"returns 403 when the roles lack the scope": {
+			storeUser:    supportUser,
+			statusCode:   http.StatusForbidden,
+			responseBody: `{"type":"about:blank","title":"Forbidden","status":403,"detail":"the api_keys:manage scope is required","instance":"/users/me/api-keys","code":"insufficient_scope"}`,
+		},
+		"returns 403 when authenticated with an api key": {
+			storeUser:    testUser,
+			apiKey:       "tdp_secret",
+			statusCode:   http.StatusForbidden,
+			responseBody: `{"type":"about:blank","title":"Forbidden","status":403,"detail":"the api_keys:manage scope is required","instance":"/users/me/api-keys","code":"insufficient_scope"}`,
+		},
+	}
+
+	for td, tt := range tests {
+		s := testStore{}
+		s.getUserReturn.user = tt.storeUser
+		s.getAPIKeyByHashReturn.apiKey = testAPIKey
+
+		h := NewHandler(httprouter.New(), &s, &testKongClient{}, &testSQSClient{}, &testLoginThrottle{}, &testMailer{}, nil)
+		r, _ := http.NewRequest("GET", "/users/me/api-keys", nil)
+		r.Header.Set(consumerCustomIDHeader, testUser.ID)
+		if tt.apiKey != "" {
+			r.Header.Set(apiKeyHeader, tt.apiKey)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if tt.statusCode != w.Code {
+			t.Errorf("%v: handler returned wrong status code: expected %v, got %v", td, tt.statusCode, w.Code)
+		}
+
+		if tt.responseBody != "" && tt.responseBody != w.Body.String() {
+			t.Errorf("%v: handler returned wrong body: expected %v, got %v", td, tt.responseBody, w.Body.String())
+		}
+	}
+}
+
+func TestAdminSetRoles(t *testing.T) {
+	tests := map[string]struct {
+		requestBody    string
+		statusCode     int
+		responseBody   string
+		setRolesCalls  int
+		addedACLGroups []string
+	}{
+		"returns 200 and mirrors the roles into acl groups": {
+			requestBody:    `{"roles":["user","admin","user"]}`,
+			statusCode:     http.StatusOK,
+			responseBody:   `{"id":"8c4a1b4e-0a3c-4b8f-9a51-0d5c1f3f6a11","username":"user-123","status":"active","api_consumer_id":"123","email":null,"email_verified_at":null,"created_at":"2018-05-01T00:00:00Z","disabled_at":null,"roles":["admin","user"]}`,
+			setRolesCalls:  1,
+			addedACLGroups: []string{"admin", "user"},
+		},
+		"returns 400 for unknown roles": {
+			requestBody:  `{"roles":["root"]}`,
+			statusCode:   http.StatusBadRequest,
+			responseBody: `{"type":"about:blank","title":"Bad Request","status":400,"detail":"request has invalid fields","instance":"/admin/users/8c4a1b4e-0a3c-4b8f-9a51-0d5c1f3f6a11/roles","code":"validation_failed","errors":[{"field":"roles","message":"unknown role \"root\""}]}`,
+		},
+		"returns 400 without roles": {
+			requestBody:  `{"roles":[]}`,
+			statusCode:   http.StatusBadRequest,
+			responseBody: `{"type":"about:blank","title":"Bad Request","status":400,"detail":"request has invalid fields","instance":"/admin/users/8c4a1b4e-0a3c-4b8f-9a51-0d5c1f3f6a11/roles","code":"validation_failed","errors":[{"field":"roles","message":"at least one role is required"}]}`,
+		},
+	}
+
+	for td, tt := range tests {
+		s := testStore{}
+		s.getUserReturn.user = testUser
+		k := testKongClient{}
+
+		h := NewHandler(httprouter.New(), &s, &k, &testSQSClient{}, &testLoginThrottle{}, &testMailer{}, nil)
+		r, _ := http.NewRequest("POST", "/admin/users/"+testUser.ID+"/roles", bytes.NewBufferString(tt.requestBody))
+		r.Header.Set(consumerGroupsHeader, "admin")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if tt.statusCode != w.Code {
+			t.Errorf("%v: handler returned wrong status code: expected %v, got %v", td, tt.statusCode, w.Code)
+		}
+
+		if tt.responseBody != w.Body.String() {
+			t.Errorf("%v: handler returned wrong body: expected %v, got %v", td, tt.responseBody, w.Body.String())
+		}
+
+		if len(s.setRolesCalls) != tt.setRolesCalls {
+			t.Errorf("%v: wrong number of role changes: expected %v, got %v", td, tt.setRolesCalls, len(s.setRolesCalls))
+		}
+
+		if !reflect.DeepEqual(k.addedACLGroups, tt.addedACLGroups) {
+			t.Errorf("%v: wrong added acl groups: expected %v, got %v", td, tt.addedACLGroups, k.addedACLGroups)
+		}
+	}
+}
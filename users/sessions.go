@@ -0,0 +1,124 @@
+package users
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/diorman/todospoc/logging"
+	"github.com/diorman/todospoc/mail"
+	"github.com/diorman/todospoc/utils"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const sessionRevocationTokenTTL = time.Hour
+
+// handleRecoverSessions emails a one-time token that signs the owner of a
+// verified email out everywhere. It always answers 202 so it can't be used to
+// find out which emails are registered.
+func (h Handler) handleRecoverSessions() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		requestBody := struct {
+			Email string `json:"email"`
+		}{}
+
+		if err := utils.DecodeJSON(w, r, &requestBody); err != nil {
+			utils.WriteProblem(w, r, err)
+			return
+		}
+		email := normalizeEmail(requestBody.Email)
+		if err := validateEmail(email); err != nil {
+			utils.WriteProblem(w, r, err)
+			return
+		}
+
+		u, err := h.store.getUserByEmail(email)
+		if err != nil && err != sql.ErrNoRows {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+		if err == nil && u.EmailVerifiedAt.Valid && !u.DisabledAt.Valid {
+			if err := h.sendSessionRevocationEmail(u); err != nil {
+				logging.FromContext(r.Context()).With(logging.Fields{"user_id": u.ID}).Errorf("%v", err)
+			}
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func (h Handler) sendSessionRevocationEmail(u user) error {
+	token, tokenHash, err := newOneTimeToken()
+	if err != nil {
+		return err
+	}
+	if err := h.store.createSessionRevocationToken(u.ID, tokenHash, time.Now().Add(sessionRevocationTokenTTL)); err != nil {
+		return fmt.Errorf("could not save session revocation token: %v", err)
+	}
+	return h.mailer.Send(mail.Message{
+		To:      u.Email.String,
+		Subject: "Sign out of all sessions",
+		Body: fmt.Sprintf("Hi %s,\n\nUse the following token to sign out of every session of your account, it expires in %v:\n\n%s\n\nIf you did not ask for it you can ignore this email.\n",
+			u.Username, sessionRevocationTokenTTL, token),
+	})
+}
+
+// handleRevokeSessions consumes a token from handleRecoverSessions and
+// rotates the user's Kong JWT credentials, which revokes every token issued
+// so far. There are no passwords or refresh tokens yet so there is nothing
+// else to reset.
+func (h Handler) handleRevokeSessions() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		requestBody := struct {
+			Token string `json:"token"`
+		}{}
+
+		if err := utils.DecodeJSON(w, r, &requestBody); err != nil {
+			utils.WriteProblem(w, r, err)
+			return
+		}
+		if requestBody.Token == "" {
+			utils.WriteProblem(w, r, utils.ValidationError{{Field: "token", Message: "token can't be empty"}})
+			return
+		}
+
+		var kongErr error
+		_, err := h.store.consumeSessionRevocationToken(hashToken(requestBody.Token), func(userID string) error {
+			u, err := h.store.getUser(userID)
+			if err != nil {
+				return err
+			}
+			if u.DisabledAt.Valid || !u.ConsumerID.Valid {
+				return nil
+			}
+			kongErr = rotateJWTCredentials(h.kong, u.ConsumerID.String)
+			return kongErr
+		})
+
+		if err == sql.ErrNoRows {
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusBadRequest, "invalid_token", "token is invalid or has expired"))
+			return
+		}
+		if kongErr != nil {
+			writeKongProblem(w, r, kongErr)
+			return
+		}
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func rotateJWTCredentials(kong KongClient, consumerID string) error {
+	if err := kong.deleteJWTCredentials(consumerID); err != nil {
+		return err
+	}
+	return kong.createJWTCredentials(consumerID)
+}
@@ -0,0 +1,96 @@
+package users
+
+import (
+	"bytes"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestHandleRecoverSessions(t *testing.T) {
+	tests := map[string]struct {
+		storeUser    user
+		storeUserErr error
+		sentEmails   int
+	}{
+		"sends a revocation token to verified emails": {
+			storeUser:  testVerifiedUser,
+			sentEmails: 1,
+		},
+		"does not send a revocation token to unverified emails": {
+			storeUser:  testUnverifiedUser,
+			sentEmails: 0,
+		},
+		"does not reveal unknown emails": {
+			storeUserErr: sql.ErrNoRows,
+			sentEmails:   0,
+		},
+	}
+
+	for td, tt := range tests {
+		s := testStore{}
+		s.getUserByEmailReturn.user = tt.storeUser
+		s.getUserByEmailReturn.err = tt.storeUserErr
+		mailer := testMailer{}
+
+		h := NewHandler(httprouter.New(), &s, &testKongClient{}, &testSQSClient{}, &testLoginThrottle{}, &mailer, nil)
+		r, _ := http.NewRequest("POST", "/sessions/recover", bytes.NewBuffer([]byte(`{"email": "user@example.com"}`)))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != http.StatusAccepted {
+			t.Errorf("%v: handler returned wrong status code: expected %v, got %v", td, http.StatusAccepted, w.Code)
+		}
+
+		if len(mailer.sent) != tt.sentEmails || len(s.sessionRevocationTokens) != tt.sentEmails {
+			t.Errorf("%v: wrong number of emails: expected %v, got %v", td, tt.sentEmails, len(mailer.sent))
+		}
+	}
+}
+
+func TestHandleRevokeSessions(t *testing.T) {
+	tests := map[string]struct {
+		statusCode       int
+		responseBody     string
+		storeConsumeErr  error
+		rotatedConsumers int
+	}{
+		"returns 204 and rotates jwt credentials when token is valid": {
+			statusCode:       http.StatusNoContent,
+			rotatedConsumers: 1,
+		},
+		"returns 400 when token is invalid or expired": {
+			statusCode:      http.StatusBadRequest,
+			responseBody:    `{"type":"about:blank","title":"Bad Request","status":400,"detail":"token is invalid or has expired","instance":"/sessions/revoke","code":"invalid_token"}`,
+			storeConsumeErr: sql.ErrNoRows,
+		},
+	}
+
+	for td, tt := range tests {
+		s := testStore{}
+		s.consumeSessionRevocationTokenReturn.userID = testVerifiedUser.ID
+		s.consumeSessionRevocationTokenReturn.err = tt.storeConsumeErr
+		s.getUserReturn.user = testVerifiedUser
+		k := testKongClient{}
+
+		h := NewHandler(httprouter.New(), &s, &k, &testSQSClient{}, &testLoginThrottle{}, &testMailer{}, nil)
+		r, _ := http.NewRequest("POST", "/sessions/revoke", bytes.NewBuffer([]byte(`{"token": "abc"}`)))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if tt.statusCode != w.Code {
+			t.Errorf("%v: handler returned wrong status code: expected %v, got %v", td, tt.statusCode, w.Code)
+		}
+
+		if tt.responseBody != w.Body.String() {
+			t.Errorf("%v: handler returned wrong body: expected %v, got %v", td, tt.responseBody, w.Body.String())
+		}
+
+		if len(k.deletedJWTCredentials) != tt.rotatedConsumers || k.createdJWTCredentials != tt.rotatedConsumers {
+			t.Errorf("%v: wrong number of rotated credentials: expected %v, got %v deleted and %v created", td, tt.rotatedConsumers, len(k.deletedJWTCredentials), k.createdJWTCredentials)
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package users
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/diorman/todospoc"
+	"github.com/diorman/todospoc/logging"
+	"github.com/diorman/todospoc/mail"
+	"github.com/diorman/todospoc/utils"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	defaultShareLinkDays = 7
+	maxShareLinkDays     = 30
+
+	listsReadScope  = "lists:read"
+	listsWriteScope = "lists:write"
+)
+
+// errAlreadyCollaborator is returned by the store when inviting a user that
+// can already reach the list.
+var errAlreadyCollaborator = errors.New("user already has access to the list")
+
+// listInvitation grants Permission on the list to the invitee once accepted.
+type listInvitation struct {
+	ID            string
+	ListID        string
+	ListName      string
+	InvitedBy     string
+	InviteeUserID sql.NullString
+	InviteeEmail  sql.NullString
+	Permission    int
+	Status        string
+	ExpiresAt     time.Time
+	CreatedAt     time.Time
+}
+
+func (inv listInvitation) status() string {
+	if inv.Status == invitationStatusPending && !inv.ExpiresAt.After(time.Now()) {
+		return invitationStatusExpired
+	}
+	return inv.Status
+}
+
+// shareLink grants Permission on the list to any signed in user redeeming
+// its token until it expires or is revoked.
+type shareLink struct {
+	ID         string
+	ListID     string
+	Permission int
+	CreatedBy  string
+	ExpiresAt  time.Time
+	CreatedAt  time.Time
+}
+
+type listInvitationResponse struct {
+	ID            string    `json:"id"`
+	ListID        string    `json:"list_id"`
+	ListName      string    `json:"list_name"`
+	InviteeUserID *string   `json:"invitee_user_id"`
+	InviteeEmail  *string   `json:"invitee_email"`
+	Permission    string    `json:"permission"`
+	Status        string    `json:"status"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+func newListInvitationResponse(inv listInvitation) listInvitationResponse {
+	res := listInvitationResponse{
+		ID:         inv.ID,
+		ListID:     inv.ListID,
+		ListName:   inv.ListName,
+		Permission: permissionNames[inv.Permission],
+		Status:     inv.status(),
+		ExpiresAt:  inv.ExpiresAt,
+		CreatedAt:  inv.CreatedAt,
+	}
+	if inv.InviteeUserID.Valid {
+		res.InviteeUserID = &inv.InviteeUserID.String
+	}
+	if inv.InviteeEmail.Valid {
+		res.InviteeEmail = &inv.InviteeEmail.String
+	}
+	return res
+}
+
+type shareLinkResponse struct {
+	ID         string    `json:"id"`
+	ListID     string    `json:"list_id"`
+	Permission string    `json:"permission"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func newShareLinkResponse(link shareLink) shareLinkResponse {
+	return shareLinkResponse{
+		ID:         link.ID,
+		ListID:     link.ListID,
+		Permission: permissionNames[link.Permission],
+		ExpiresAt:  link.ExpiresAt,
+		CreatedAt:  link.CreatedAt,
+	}
+}
+
+func listIDParam(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (string, bool) {
+	listID := ps.ByName("listID")
+	if !uuidPattern.MatchString(listID) {
+		utils.WriteProblem(w, r, utils.NewProblem(http.StatusNotFound, "list_not_found", ""))
+		return "", false
+	}
+	return listID, true
+}
+
+// handleCreateListInvitation invites a user by username or email to a list
+// the signed in user can share, i.e. owns or manages through its
+// organization. Lists the user can't share are reported as not found.
+func (h Handler) handleCreateListInvitation() httprouter.Handle {
+	return h.requireScope(listsWriteScope, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params, u user) {
+		listID, ok := listIDParam(w, r, ps)
+		if !ok {
+			return
+		}
+		requestBody := struct {
+			inviteeRequest
+			Permission string `json:"permission"`
+		}{Permission: permissionNames[permissionRead]}
+
+		if err := utils.DecodeJSON(w, r, &requestBody); err != nil {
+			utils.WriteProblem(w, r, err)
+			return
+		}
+
+		fieldErrors := requestBody.inviteeRequest.validate()
+		permission, ok := parsePermission(requestBody.Permission)
+		if !ok {
+			fieldErrors = append(fieldErrors, utils.FieldError{Field: "permission", Message: "must be one of read or write"})
+		}
+		if len(fieldErrors) > 0 {
+			utils.WriteProblem(w, r, fieldErrors)
+			return
+		}
+
+		inv := listInvitation{
+			ListID:     listID,
+			InvitedBy:  u.ID,
+			Permission: permission,
+			ExpiresAt:  time.Now().Add(invitationTTL),
+		}
+		to, err := h.resolveInvitee(r, requestBody.inviteeRequest)
+		if err != nil {
+			utils.WriteProblem(w, r, err)
+			return
+		}
+		inv.InviteeUserID, inv.InviteeEmail = to.userID, to.email
+
+		inv, err = h.store.createListInvitation(u.ID, inv)
+		if err == sql.ErrNoRows {
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusNotFound, "list_not_found", ""))
+			return
+		}
+		if err == errAlreadyCollaborator {
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusConflict, "already_collaborator", "user already has access to the list"))
+			return
+		}
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+
+		h.notifyListInvitee(r, u, inv, to)
+		utils.WriteJSON(w, http.StatusCreated, newListInvitationResponse(inv))
+	})
+}
+
+func (h Handler) notifyListInvitee(r *http.Request, inviter user, inv listInvitation, to invitee) {
+	h.notifyInvitee(r, inv.ID, to, listInvitationCreatedEvent, listInvitationCreatedPayload{
+		InvitationID:  inv.ID,
+		ListID:        inv.ListID,
+		InviteeUserID: inv.InviteeUserID.String,
+		InviteeEmail:  inv.InviteeEmail.String,
+		Permission:    permissionNames[inv.Permission],
+	}, mail.Message{
+		Subject: fmt.Sprintf("%s shared %s with you", inviter.Username, inv.ListName),
+		Body: fmt.Sprintf("Hi,\n\n%s invited you to %s the list %s. Sign in to accept or decline the invitation, it expires in %v.\n",
+			inviter.Username, permissionNames[inv.Permission], inv.ListName, invitationTTL),
+	})
+}
+
+func (h Handler) handleListListInvitations() httprouter.Handle {
+	return h.requireScope(listsReadScope, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params, u user) {
+		invitations, err := h.store.listListInvitations(u.ID)
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+
+		response := struct {
+			Invitations []listInvitationResponse `json:"invitations"`
+		}{[]listInvitationResponse{}}
+		for _, inv := range invitations {
+			response.Invitations = append(response.Invitations, newListInvitationResponse(inv))
+		}
+
+		utils.WriteJSON(w, http.StatusOK, response)
+	})
+}
+
+func (h Handler) handleRespondToListInvitation(accept bool) httprouter.Handle {
+	return h.requireScope(listsWriteScope, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params, u user) {
+		invitationID := ps.ByName("invitationID")
+		if !uuidPattern.MatchString(invitationID) {
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusNotFound, "invitation_not_found", ""))
+			return
+		}
+
+		inv, err := h.store.respondToListInvitation(u.ID, invitationID, accept)
+		if err == sql.ErrNoRows {
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusNotFound, "invitation_not_found", "invitation doesn't exist, expired or was already answered"))
+			return
+		}
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+
+		utils.WriteJSON(w, http.StatusOK, newListInvitationResponse(inv))
+	})
+}
+
+// handleCreateShareLink returns the token in the response only, it is stored
+// hashed like API keys.
+func (h Handler) handleCreateShareLink() httprouter.Handle {
+	return h.requireScope(listsWriteScope, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params, u user) {
+		listID, ok := listIDParam(w, r, ps)
+		if !ok {
+			return
+		}
+		requestBody := struct {
+			Permission    string `json:"permission"`
+			ExpiresInDays int    `json:"expires_in_days"`
+		}{Permission: permissionNames[permissionRead], ExpiresInDays: defaultShareLinkDays}
+
+		if err := utils.DecodeJSON(w, r, &requestBody); err != nil {
+			utils.WriteProblem(w, r, err)
+			return
+		}
+
+		var fieldErrors utils.ValidationError
+		permission, ok := parsePermission(requestBody.Permission)
+		if !ok {
+			fieldErrors = append(fieldErrors, utils.FieldError{Field: "permission", Message: "must be one of read or write"})
+		}
+		if requestBody.ExpiresInDays < 1 || requestBody.ExpiresInDays > maxShareLinkDays {
+			fieldErrors = append(fieldErrors, utils.FieldError{Field: "expires_in_days", Message: fmt.Sprintf("must be a number between 1 and %d", maxShareLinkDays)})
+		}
+		if len(fieldErrors) > 0 {
+			utils.WriteProblem(w, r, fieldErrors)
+			return
+		}
+
+		token, tokenHash, err := newOneTimeToken()
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+
+		link, err := h.store.createShareLink(u.ID, shareLink{
+			ListID:     listID,
+			Permission: permission,
+			ExpiresAt:  time.Now().Add(time.Duration(requestBody.ExpiresInDays) * 24 * time.Hour),
+		}, tokenHash)
+		if err == sql.ErrNoRows {
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusNotFound, "list_not_found", ""))
+			return
+		}
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+
+		response := struct {
+			shareLinkResponse
+			Token string `json:"token"`
+		}{newShareLinkResponse(link), token}
+
+		utils.WriteJSON(w, http.StatusCreated, response)
+	})
+}
+
+func (h Handler) handleRevokeShareLink() httprouter.Handle {
+	return h.requireScope(listsWriteScope, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params, u user) {
+		listID, ok := listIDParam(w, r, ps)
+		if !ok {
+			return
+		}
+		linkID := ps.ByName("linkID")
+		if !uuidPattern.MatchString(linkID) {
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusNotFound, "share_link_not_found", ""))
+			return
+		}
+
+		err := h.store.revokeShareLink(u.ID, listID, linkID)
+		if err == sql.ErrNoRows {
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusNotFound, "share_link_not_found", ""))
+			return
+		}
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// handleRedeemShareLink grants the permission of the link to the signed in
+// user, permissions they already have are never downgraded.
+func (h Handler) handleRedeemShareLink() httprouter.Handle {
+	return h.requireScope(listsWriteScope, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params, u user) {
+		requestBody := struct {
+			Token string `json:"token"`
+		}{}
+
+		if err := utils.DecodeJSON(w, r, &requestBody); err != nil {
+			utils.WriteProblem(w, r, err)
+			return
+		}
+		if requestBody.Token == "" {
+			utils.WriteProblem(w, r, utils.ValidationError{{Field: "token", Message: "token can't be empty"}})
+			return
+		}
+
+		link, err := h.store.redeemShareLink(u.ID, hashToken(requestBody.Token))
+		if err == sql.ErrNoRows {
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusNotFound, "share_link_not_found", "share link doesn't exist, expired or was revoked"))
+			return
+		}
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+
+		e, err := newEvent(listSharedEvent, logging.RequestID(r.Context()), listSharedPayload{
+			ListID:      link.ListID,
+			UserID:      u.ID,
+			Permission:  permissionNames[link.Permission],
+			ShareLinkID: link.ID,
+		})
+		if err == nil {
+			err = h.sqs.SendMessage(todospoc.Config.UserEventsQueueName, e)
+		}
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+		}
+
+		utils.WriteJSON(w, http.StatusOK, newShareLinkResponse(link))
+	})
+}
@@ -0,0 +1,263 @@
+package users
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const testListID = "3c2b1a09-8f7e-4d6c-9b5a-4e3d2c1b0a9f"
+
+func TestCreateListInvitation(t *testing.T) {
+	tests := map[string]struct {
+		requestBody     string
+		storeInvitee    user
+		storeInviteeErr error
+		storeInviteErr  error
+		statusCode      int
+		responseBody    string
+		permission      int
+		inviteeUserID   string
+		inviteeEmail    string
+		sentMessages    int
+		sentEmails      int
+	}{
+		"returns 201 and invites a user with write permission": {
+			requestBody:   `{"username":"invitee","permission":"write"}`,
+			storeInvitee:  testInvitee,
+			statusCode:    http.StatusCreated,
+			permission:    permissionWrite,
+			inviteeUserID: testInvitee.ID,
+			sentMessages:  1,
+			sentEmails:    1,
+		},
+		"returns 201 and keeps the email when its account hasn't verified it": {
+			requestBody:  `{"email":"invitee@example.com"}`,
+			storeInvitee: testUnverifiedInvitee,
+			statusCode:   http.StatusCreated,
+			permission:   permissionRead,
+			inviteeEmail: "invitee@example.com",
+			sentMessages: 1,
+			sentEmails:   1,
+		},
+		"returns 400 for an unknown permission": {
+			requestBody:  `{"username":"invitee","permission":"admin"}`,
+			statusCode:   http.StatusBadRequest,
+			responseBody: `{"type":"about:blank","title":"Bad Request","status":400,"detail":"request has invalid fields","instance":"/lists/3c2b1a09-8f7e-4d6c-9b5a-4e3d2c1b0a9f/invitations","code":"validation_failed","errors":[{"field":"permission","message":"must be one of read or write"}]}`,
+		},
+		"returns 404 for lists the user can't share": {
+			requestBody:    `{"username":"invitee"}`,
+			storeInvitee:   testInvitee,
+			storeInviteErr: sql.ErrNoRows,
+			statusCode:     http.StatusNotFound,
+			responseBody:   `{"type":"about:blank","title":"Not Found","status":404,"instance":"/lists/3c2b1a09-8f7e-4d6c-9b5a-4e3d2c1b0a9f/invitations","code":"list_not_found"}`,
+			permission:     permissionRead,
+		},
+		"returns 409 when the user already has access": {
+			requestBody:    `{"username":"invitee"}`,
+			storeInvitee:   testInvitee,
+			storeInviteErr: errAlreadyCollaborator,
+			statusCode:     http.StatusConflict,
+			responseBody:   `{"type":"about:blank","title":"Conflict","status":409,"detail":"user already has access to the list","instance":"/lists/3c2b1a09-8f7e-4d6c-9b5a-4e3d2c1b0a9f/invitations","code":"already_collaborator"}`,
+			permission:     permissionRead,
+		},
+	}
+
+	for td, tt := range tests {
+		s := testStore{}
+		s.getUserReturn.user = testUser
+		s.getUserByUsernameReturn.user = tt.storeInvitee
+		s.getUserByUsernameReturn.err = tt.storeInviteeErr
+		s.createListInvitationReturn.err = tt.storeInviteErr
+		s.createListInvitationReturn.invitation = listInvitation{
+			ID:            "9a8b7c6d-5e4f-4a3b-2c1d-0e9f8a7b6c5d",
+			ListID:        testListID,
+			ListName:      "Chores",
+			InviteeUserID: sql.NullString{String: tt.inviteeUserID, Valid: tt.inviteeUserID != ""},
+			InviteeEmail:  sql.NullString{String: tt.inviteeEmail, Valid: tt.inviteeEmail != ""},
+			Permission:    tt.permission,
+			Status:        invitationStatusPending,
+			ExpiresAt:     time.Now().Add(time.Hour),
+		}
+		sqsClient := testSQSClient{}
+		mailer := testMailer{}
+
+		h := NewHandler(httprouter.New(), &s, &testKongClient{}, &sqsClient, &testLoginThrottle{}, &mailer, nil)
+		r, _ := http.NewRequest("POST", "/lists/"+testListID+"/invitations", bytes.NewBufferString(tt.requestBody))
+		r.Header.Set(consumerCustomIDHeader, testUser.ID)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if tt.statusCode != w.Code {
+			t.Errorf("%v: handler returned wrong status code: expected %v, got %v", td, tt.statusCode, w.Code)
+		}
+
+		if tt.responseBody != "" && tt.responseBody != w.Body.String() {
+			t.Errorf("%v: handler returned wrong body: expected %v, got %v", td, tt.responseBody, w.Body.String())
+		}
+
+		if tt.permission != 0 && (len(s.createdListInvitations) != 1 || s.createdListInvitations[0].Permission != tt.permission) {
+			t.Errorf("%v: expected an invitation with permission %v, got %+v", td, tt.permission, s.createdListInvitations)
+		}
+
+		if tt.inviteeUserID != "" || tt.inviteeEmail != "" {
+			if inv := s.createdListInvitations[0]; inv.InviteeUserID.String != tt.inviteeUserID || inv.InviteeEmail.String != tt.inviteeEmail {
+				t.Errorf("%v: wrong invitee: expected %q %q, got %q %q", td, tt.inviteeUserID, tt.inviteeEmail, inv.InviteeUserID.String, inv.InviteeEmail.String)
+			}
+		}
+
+		if len(sqsClient.sentMessages) != tt.sentMessages {
+			t.Errorf("%v: wrong number of events: expected %v, got %v", td, tt.sentMessages, len(sqsClient.sentMessages))
+		}
+
+		if len(mailer.sent) != tt.sentEmails {
+			t.Errorf("%v: wrong number of emails: expected %v, got %v", td, tt.sentEmails, len(mailer.sent))
+		}
+	}
+}
+
+func TestCreateShareLink(t *testing.T) {
+	tests := map[string]struct {
+		requestBody  string
+		storeErr     error
+		statusCode   int
+		responseBody string
+	}{
+		"returns 201 and the token": {
+			requestBody: `{"permission":"write","expires_in_days":30}`,
+			statusCode:  http.StatusCreated,
+		},
+		"returns 400 for an expiry out of range": {
+			requestBody:  `{"expires_in_days":31}`,
+			statusCode:   http.StatusBadRequest,
+			responseBody: `{"type":"about:blank","title":"Bad Request","status":400,"detail":"request has invalid fields","instance":"/lists/3c2b1a09-8f7e-4d6c-9b5a-4e3d2c1b0a9f/share-links","code":"validation_failed","errors":[{"field":"expires_in_days","message":"must be a number between 1 and 30"}]}`,
+		},
+		"returns 404 for lists the user can't share": {
+			requestBody:  `{}`,
+			storeErr:     sql.ErrNoRows,
+			statusCode:   http.StatusNotFound,
+			responseBody: `{"type":"about:blank","title":"Not Found","status":404,"instance":"/lists/3c2b1a09-8f7e-4d6c-9b5a-4e3d2c1b0a9f/share-links","code":"list_not_found"}`,
+		},
+	}
+
+	for td, tt := range tests {
+		s := testStore{}
+		s.getUserReturn.user = testUser
+		s.createShareLinkReturn.shareLink = shareLink{ID: "5f0e7d4c-3b2a-4c19-8e07-6d5c4b3a2f10", ListID: testListID, Permission: permissionWrite}
+		s.createShareLinkReturn.err = tt.storeErr
+
+		h := NewHandler(httprouter.New(), &s, &testKongClient{}, &testSQSClient{}, &testLoginThrottle{}, &testMailer{}, nil)
+		r, _ := http.NewRequest("POST", "/lists/"+testListID+"/share-links", bytes.NewBufferString(tt.requestBody))
+		r.Header.Set(consumerCustomIDHeader, testUser.ID)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if tt.statusCode != w.Code {
+			t.Errorf("%v: handler returned wrong status code: expected %v, got %v", td, tt.statusCode, w.Code)
+		}
+
+		if tt.responseBody != "" && tt.responseBody != w.Body.String() {
+			t.Errorf("%v: handler returned wrong body: expected %v, got %v", td, tt.responseBody, w.Body.String())
+		}
+
+		if tt.statusCode == http.StatusCreated {
+			response := struct {
+				Permission string `json:"permission"`
+				Token      string `json:"token"`
+			}{}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatalf("%v: unexpected error: %v", td, err)
+			}
+			if response.Permission != "write" || response.Token == "" || s.createdShareLinkHashes[0] != hashToken(response.Token) {
+				t.Errorf("%v: expected the token to be returned and stored hashed, got %v", td, w.Body.String())
+			}
+		}
+	}
+}
+
+func TestRedeemShareLink(t *testing.T) {
+	tests := map[string]struct {
+		requestBody  string
+		storeErr     error
+		statusCode   int
+		sentMessages int
+	}{
+		"returns 200 and grants the permission": {
+			requestBody:  `{"token":"secret"}`,
+			statusCode:   http.StatusOK,
+			sentMessages: 1,
+		},
+		"returns 400 without a token": {
+			requestBody: `{}`,
+			statusCode:  http.StatusBadRequest,
+		},
+		"returns 404 for expired or revoked links": {
+			requestBody: `{"token":"secret"}`,
+			storeErr:    sql.ErrNoRows,
+			statusCode:  http.StatusNotFound,
+		},
+	}
+
+	for td, tt := range tests {
+		s := testStore{}
+		s.getUserReturn.user = testUser
+		s.redeemShareLinkReturn.shareLink = shareLink{ID: "5f0e7d4c-3b2a-4c19-8e07-6d5c4b3a2f10", ListID: testListID, Permission: permissionRead}
+		s.redeemShareLinkReturn.err = tt.storeErr
+		sqsClient := testSQSClient{}
+
+		h := NewHandler(httprouter.New(), &s, &testKongClient{}, &sqsClient, &testLoginThrottle{}, &testMailer{}, nil)
+		r, _ := http.NewRequest("POST", "/users/me/share-links/redeem", bytes.NewBufferString(tt.requestBody))
+		r.Header.Set(consumerCustomIDHeader, testUser.ID)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if tt.statusCode != w.Code {
+			t.Errorf("%v: handler returned wrong status code: expected %v, got %v", td, tt.statusCode, w.Code)
+		}
+
+		if len(sqsClient.sentMessages) != tt.sentMessages {
+			t.Errorf("%v: wrong number of events: expected %v, got %v", td, tt.sentMessages, len(sqsClient.sentMessages))
+		}
+
+		if tt.storeErr == nil && tt.statusCode == http.StatusOK && s.redeemedShareLinks[0] != hashToken("secret") {
+			t.Errorf("%v: expected the token to be looked up by its hash", td)
+		}
+	}
+}
+
+func TestRevokeShareLink(t *testing.T) {
+	tests := map[string]struct {
+		storeErr   error
+		statusCode int
+	}{
+		"returns 204 when revoked": {
+			statusCode: http.StatusNoContent,
+		},
+		"returns 404 for unknown links": {
+			storeErr:   sql.ErrNoRows,
+			statusCode: http.StatusNotFound,
+		},
+	}
+
+	for td, tt := range tests {
+		s := testStore{}
+		s.getUserReturn.user = testUser
+		s.revokeShareLinkReturn.err = tt.storeErr
+
+		h := NewHandler(httprouter.New(), &s, &testKongClient{}, &testSQSClient{}, &testLoginThrottle{}, &testMailer{}, nil)
+		r, _ := http.NewRequest("DELETE", "/lists/"+testListID+"/share-links/5f0e7d4c-3b2a-4c19-8e07-6d5c4b3a2f10", nil)
+		r.Header.Set(consumerCustomIDHeader, testUser.ID)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if tt.statusCode != w.Code {
+			t.Errorf("%v: handler returned wrong status code: expected %v, got %v", td, tt.statusCode, w.Code)
+		}
+	}
+}
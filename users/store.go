@@ -2,12 +2,77 @@ package users
 
 import (
 	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/diorman/todospoc"
+	"github.com/lib/pq"
 )
 
 type Store interface {
-	saveUser(username string, txFunc func(userID string) error) (string, error)
-	getConsumerID(username string) (string, error)
+	saveUser(username string, email sql.NullString, txFunc func(userID string) error) (string, error)
+	getUserByUsername(username string) (user, error)
+	getUserByEmail(email string) (user, error)
+	getUser(userID string) (user, error)
+	listUsers(filter userFilter) ([]user, error)
 	setConsumerID(userID, consumerID string) error
+	withUserLock(userID string, fn func() error) error
+	tryAdvisoryLock(key int64, fn func() error) (bool, error)
+	clearConsumerID(userID string) error
+	setProvisioningFailed(userID string) error
+	setDisabled(userID string, disabled bool) error
+	countUnprovisionedUsers() (int, error)
+	createVerificationToken(userID, tokenHash string, expiresAt time.Time) error
+	verifyEmail(tokenHash string, txFunc func(userID string) error) (string, error)
+	createSessionRevocationToken(userID, tokenHash string, expiresAt time.Time) error
+	consumeSessionRevocationToken(tokenHash string, txFunc func(userID string) error) (string, error)
+	saveUserWithIdentity(username string, verifiedEmail sql.NullString, id identity, txFunc func(userID string) error) (string, error)
+	getUserByIdentity(id identity) (user, error)
+	linkIdentity(userID string, id identity) error
+	saveLoginState(stateHash string, st loginState) error
+	consumeLoginState(stateHash string) (loginState, error)
+	saveAPIKey(k apiKey, keyHash string) (apiKey, error)
+	listAPIKeys(userID string) ([]apiKey, error)
+	getAPIKey(userID, keyID string) (apiKey, error)
+	getAPIKeyByHash(keyHash string) (apiKey, error)
+	revokeAPIKey(keyID string) error
+	revokeAPIKeys(userID string) error
+	setRoles(userID string, roles []string) error
+
+	// The organization methods act on behalf of userID and never reach
+	// organizations that user isn't a member of.
+	createOrganization(userID, name string, memberPermission int) (organization, error)
+	listOrganizations(userID string) ([]organization, error)
+	getOrganization(userID, orgID string) (organization, error)
+	listOrganizationMembers(userID, orgID string) ([]organizationMember, error)
+	changeOrganizationMember(userID, orgID, memberID, role string) (organizationMember, error)
+	setListOrganization(userID, listID string, orgID sql.NullString) error
+	createOrganizationInvitation(userID string, inv organizationInvitation) (organizationInvitation, error)
+	listInvitations(userID string) ([]organizationInvitation, error)
+	respondToInvitation(userID, invitationID string, accept bool) (organizationInvitation, error)
+
+	// The list sharing methods only act on lists userID can share, see
+	// canShareListCondition.
+	createListInvitation(userID string, inv listInvitation) (listInvitation, error)
+	listListInvitations(userID string) ([]listInvitation, error)
+	respondToListInvitation(userID, invitationID string, accept bool) (listInvitation, error)
+	createShareLink(userID string, link shareLink, tokenHash string) (shareLink, error)
+	revokeShareLink(userID, listID, linkID string) error
+	redeemShareLink(userID, tokenHash string) (shareLink, error)
+}
+
+const userColumns = "id, username, api_consumer_id, provisioning_status, email, email_verified_at, created_at, disabled_at, " +
+	"ARRAY(SELECT role FROM user_roles WHERE user_roles.user_id=users.id ORDER BY role)"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanUser(row rowScanner) (user, error) {
+	var u user
+	err := row.Scan(&u.ID, &u.Username, &u.ConsumerID, &u.ProvisioningStatus, &u.Email, &u.EmailVerifiedAt, &u.CreatedAt, &u.DisabledAt, pq.Array(&u.Roles))
+	return u, err
 }
 
 type storeImpl struct {
@@ -18,7 +83,33 @@ func NewStore(db *sql.DB) Store {
 	return &storeImpl{db}
 }
 
-func (s *storeImpl) saveUser(username string, txFunc func(userID string) error) (string, error) {
+func (s *storeImpl) saveUser(username string, email sql.NullString, txFunc func(userID string) error) (string, error) {
+	return s.insertUser(func(tx *sql.Tx) (string, error) {
+		var userID string
+		err := tx.QueryRow("INSERT INTO users(username, email) VALUES($1, $2) RETURNING id", username, email).Scan(&userID)
+		return userID, err
+	}, txFunc)
+}
+
+// saveUserWithIdentity creates a user signed up through an identity provider.
+// The email, if any, was verified by the provider.
+func (s *storeImpl) saveUserWithIdentity(username string, verifiedEmail sql.NullString, id identity, txFunc func(userID string) error) (string, error) {
+	return s.insertUser(func(tx *sql.Tx) (string, error) {
+		var userID string
+		err := tx.QueryRow(`INSERT INTO users(username, email, email_verified_at)
+			VALUES($1, $2, CASE WHEN $2::text IS NULL THEN NULL ELSE now() END) RETURNING id`, username, verifiedEmail).Scan(&userID)
+		if err != nil {
+			return "", err
+		}
+		if err := releaseUnverifiedEmail(tx, userID); err != nil {
+			return "", err
+		}
+		_, err = tx.Exec("INSERT INTO identities(user_id, issuer, subject) VALUES($1, $2, $3)", userID, id.Issuer, id.Subject)
+		return userID, err
+	}, txFunc)
+}
+
+func (s *storeImpl) insertUser(insert func(tx *sql.Tx) (string, error), txFunc func(userID string) error) (string, error) {
 	tx, err := s.Begin()
 	if err != nil {
 		return "", err
@@ -31,13 +122,11 @@ func (s *storeImpl) saveUser(username string, txFunc func(userID string) error)
 		return err
 	}
 
-	stmt, err := tx.Prepare("INSERT INTO users(username) VALUES($1) RETURNING id")
-	if err != nil {
-		return "", handleError(tx, err)
+	userID, err := insert(tx)
+	if err == nil {
+		_, err = tx.Exec("INSERT INTO user_roles(user_id, role) VALUES($1, $2)", userID, roleUser)
 	}
-
-	var userID string
-	if err := stmt.QueryRow(username).Scan(&userID); err != nil {
+	if err != nil {
 		return "", handleError(tx, err)
 	}
 
@@ -52,18 +141,716 @@ func (s *storeImpl) saveUser(username string, txFunc func(userID string) error)
 	return userID, nil
 }
 
-func (s *storeImpl) getConsumerID(username string) (string, error) {
-	var consumerID string
-	row := s.QueryRow("SELECT api_consumer_id FROM users WHERE username=$1", username)
-	if err := row.Scan(&consumerID); err != nil {
-		return "", err
+func (s *storeImpl) getUserByUsername(username string) (user, error) {
+	return scanUser(s.QueryRow("SELECT "+userColumns+" FROM users WHERE lower(username)=lower($1)", username))
+}
+
+func (s *storeImpl) getUserByEmail(email string) (user, error) {
+	return scanUser(s.QueryRow("SELECT "+userColumns+" FROM users WHERE lower(email)=lower($1) ORDER BY email_verified_at IS NULL, created_at DESC LIMIT 1", email))
+}
+
+func (s *storeImpl) getUser(userID string) (user, error) {
+	return scanUser(s.QueryRow("SELECT "+userColumns+" FROM users WHERE id=$1", userID))
+}
+
+func (s *storeImpl) listUsers(filter userFilter) ([]user, error) {
+	var (
+		conditions []string
+		args       []interface{}
+	)
+	addCondition := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if filter.UsernamePrefix != "" {
+		addCondition(`lower(username) LIKE lower($%d) || '%%'`, escapeLike(filter.UsernamePrefix))
+	}
+	if filter.After != "" {
+		addCondition("lower(username) > lower($%d)", filter.After)
+	}
+	switch filter.Status {
+	case userStatusPending, userStatusActive, userStatusFailed:
+		conditions = append(conditions, "disabled_at IS NULL")
+		addCondition("provisioning_status=$%d", filter.Status)
+	case userStatusDisabled:
+		conditions = append(conditions, "disabled_at IS NOT NULL")
+	}
+
+	query := "SELECT " + userColumns + " FROM users"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
 	}
-	return consumerID, nil
+	args = append(args, filter.Limit)
+	query += fmt.Sprintf(" ORDER BY lower(username) LIMIT $%d", len(args))
+
+	rows, err := s.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []user{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// withUserLock runs fn holding a transaction level advisory lock on the user,
+// so that only one of the worker, the inline attempt and the reconciler
+// provisions them at a time.
+func (s *storeImpl) withUserLock(userID string, fn func() error) error {
+	tx, err := s.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext($1))", userID); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// tryAdvisoryLock runs fn holding the transaction level advisory lock key,
+// it returns false without running fn when someone else holds it.
+func (s *storeImpl) tryAdvisoryLock(key int64, fn func() error) (bool, error) {
+	tx, err := s.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	var locked bool
+	if err := tx.QueryRow("SELECT pg_try_advisory_xact_lock($1)", key).Scan(&locked); err != nil {
+		return false, err
+	}
+	if !locked {
+		return false, nil
+	}
+	if err := fn(); err != nil {
+		return true, err
+	}
+	return true, tx.Commit()
 }
 
 func (s *storeImpl) setConsumerID(userID, consumerID string) error {
-	if _, err := s.Exec("UPDATE users SET api_consumer_id=$1 WHERE id=$2", consumerID, userID); err != nil {
+	if _, err := s.Exec("UPDATE users SET api_consumer_id=$1, provisioning_status='active' WHERE id=$2", consumerID, userID); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *storeImpl) clearConsumerID(userID string) error {
+	if _, err := s.Exec("UPDATE users SET api_consumer_id=NULL, provisioning_status='pending' WHERE id=$1", userID); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *storeImpl) setProvisioningFailed(userID string) error {
+	if _, err := s.Exec("UPDATE users SET provisioning_status='failed' WHERE id=$1 AND provisioning_status='pending'", userID); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *storeImpl) setDisabled(userID string, disabled bool) error {
+	query := "UPDATE users SET disabled_at=NULL WHERE id=$1"
+	if disabled {
+		query = "UPDATE users SET disabled_at=coalesce(disabled_at, now()) WHERE id=$1"
+	}
+	res, err := s.Exec(query, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// countUnprovisionedUsers leaves out the users held back until they verify
+// their email, see user.awaitingVerification.
+func (s *storeImpl) countUnprovisionedUsers() (int, error) {
+	var count int
+	err := s.QueryRow(`SELECT count(*) FROM users WHERE provisioning_status='pending'
+		AND NOT ($1 AND email IS NOT NULL AND email_verified_at IS NULL)`, todospoc.Config.RequireEmailVerification).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// createVerificationToken replaces any previous token of the user so only the
+// latest email sent can be used.
+func (s *storeImpl) createVerificationToken(userID, tokenHash string, expiresAt time.Time) error {
+	tx, err := s.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM email_verification_tokens WHERE user_id=$1", userID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO email_verification_tokens(token_hash, user_id, expires_at) VALUES($1, $2, $3)", tokenHash, userID, expiresAt); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// verifyEmail consumes the token and marks the email of its user as verified,
+// it returns sql.ErrNoRows when the token does not exist, has expired or
+// another account verified the email first.
+func (s *storeImpl) verifyEmail(tokenHash string, txFunc func(userID string) error) (string, error) {
+	tx, err := s.Begin()
+	if err != nil {
+		return "", err
+	}
+
+	var userID string
+	err = tx.QueryRow("DELETE FROM email_verification_tokens WHERE token_hash=$1 AND expires_at > now() RETURNING user_id", tokenHash).Scan(&userID)
+	if err == nil {
+		err = claimVerifiedEmail(tx, userID)
+	}
+	if err == nil {
+		err = txFunc(userID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return userID, nil
+}
+
+func (s *storeImpl) createSessionRevocationToken(userID, tokenHash string, expiresAt time.Time) error {
+	tx, err := s.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM session_revocation_tokens WHERE user_id=$1", userID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO session_revocation_tokens(token_hash, user_id, expires_at) VALUES($1, $2, $3)", tokenHash, userID, expiresAt); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// consumeSessionRevocationToken deletes the token and runs txFunc before
+// committing, so the token stays usable if txFunc fails. It returns
+// sql.ErrNoRows when the token does not exist or has expired.
+func (s *storeImpl) consumeSessionRevocationToken(tokenHash string, txFunc func(userID string) error) (string, error) {
+	tx, err := s.Begin()
+	if err != nil {
+		return "", err
+	}
+
+	var userID string
+	err = tx.QueryRow("DELETE FROM session_revocation_tokens WHERE token_hash=$1 AND expires_at > now() RETURNING user_id", tokenHash).Scan(&userID)
+	if err == nil {
+		err = txFunc(userID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return userID, nil
+}
+
+// claimVerifiedEmail marks the email of the user as verified and takes it
+// away from accounts that signed up with it but never verified it. It returns
+// sql.ErrNoRows when another account already verified the email.
+func claimVerifiedEmail(tx *sql.Tx, userID string) error {
+	res, err := tx.Exec(`UPDATE users SET email_verified_at=COALESCE(email_verified_at, now()) WHERE id=$1 AND email IS NOT NULL
+		AND NOT EXISTS (SELECT 1 FROM users o WHERE lower(o.email)=lower(users.email) AND o.id<>users.id AND o.email_verified_at IS NOT NULL)`, userID)
+	if pgerr, ok := err.(*pq.Error); ok && pgerr.Code == "23505" {
+		return sql.ErrNoRows
+	}
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return releaseUnverifiedEmail(tx, userID)
+}
+
+// releaseUnverifiedEmail clears the email of the user from other accounts
+// that haven't verified it, so signing up with someone else's email can't
+// keep them from using it.
+func releaseUnverifiedEmail(tx *sql.Tx, userID string) error {
+	_, err := tx.Exec(`UPDATE users SET email=NULL WHERE id<>$1 AND email_verified_at IS NULL
+		AND lower(email)=(SELECT lower(email) FROM users WHERE id=$1)`, userID)
+	return err
+}
+
+func (s *storeImpl) getUserByIdentity(id identity) (user, error) {
+	return scanUser(s.QueryRow("SELECT "+userColumns+" FROM users WHERE id=(SELECT user_id FROM identities WHERE issuer=$1 AND subject=$2)", id.Issuer, id.Subject))
+}
+
+func (s *storeImpl) linkIdentity(userID string, id identity) error {
+	if _, err := s.Exec("INSERT INTO identities(user_id, issuer, subject) VALUES($1, $2, $3)", userID, id.Issuer, id.Subject); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *storeImpl) saveLoginState(stateHash string, st loginState) error {
+	if _, err := s.Exec("INSERT INTO oidc_login_states(state_hash, code_verifier, nonce, link_user_id, expires_at) VALUES($1, $2, $3, $4, $5)",
+		stateHash, st.CodeVerifier, st.Nonce, st.LinkUserID, st.ExpiresAt); err != nil {
+		return err
+	}
+	return nil
+}
+
+// consumeLoginState returns sql.ErrNoRows when the state is unknown, already
+// used or expired.
+func (s *storeImpl) consumeLoginState(stateHash string) (loginState, error) {
+	var st loginState
+	err := s.QueryRow("DELETE FROM oidc_login_states WHERE state_hash=$1 AND expires_at > now() RETURNING code_verifier, nonce, link_user_id, expires_at", stateHash).
+		Scan(&st.CodeVerifier, &st.Nonce, &st.LinkUserID, &st.ExpiresAt)
+	return st, err
+}
+
+const apiKeyColumns = "id, user_id, name, prefix, scopes, kong_credential_id, created_at"
+
+func scanAPIKey(row rowScanner) (apiKey, error) {
+	var k apiKey
+	err := row.Scan(&k.ID, &k.UserID, &k.Name, &k.Prefix, pq.Array(&k.Scopes), &k.KongCredentialID, &k.CreatedAt)
+	return k, err
+}
+
+func (s *storeImpl) saveAPIKey(k apiKey, keyHash string) (apiKey, error) {
+	return scanAPIKey(s.QueryRow("INSERT INTO api_keys(user_id, name, prefix, scopes, kong_credential_id, key_hash) VALUES($1, $2, $3, $4, $5, $6) RETURNING "+apiKeyColumns,
+		k.UserID, k.Name, k.Prefix, pq.Array(k.Scopes), k.KongCredentialID, keyHash))
+}
+
+func (s *storeImpl) listAPIKeys(userID string) ([]apiKey, error) {
+	rows, err := s.Query("SELECT "+apiKeyColumns+" FROM api_keys WHERE user_id=$1 AND revoked_at IS NULL ORDER BY created_at", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []apiKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (s *storeImpl) getAPIKey(userID, keyID string) (apiKey, error) {
+	return scanAPIKey(s.QueryRow("SELECT "+apiKeyColumns+" FROM api_keys WHERE id=$1 AND user_id=$2 AND revoked_at IS NULL", keyID, userID))
+}
+
+func (s *storeImpl) getAPIKeyByHash(keyHash string) (apiKey, error) {
+	return scanAPIKey(s.QueryRow("SELECT "+apiKeyColumns+" FROM api_keys WHERE key_hash=$1 AND revoked_at IS NULL", keyHash))
+}
+
+func (s *storeImpl) revokeAPIKey(keyID string) error {
+	if _, err := s.Exec("UPDATE api_keys SET revoked_at=now() WHERE id=$1 AND revoked_at IS NULL", keyID); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *storeImpl) revokeAPIKeys(userID string) error {
+	if _, err := s.Exec("UPDATE api_keys SET revoked_at=now() WHERE user_id=$1 AND revoked_at IS NULL", userID); err != nil {
 		return err
 	}
 	return nil
 }
+
+func (s *storeImpl) setRoles(userID string, roles []string) error {
+	tx, err := s.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM user_roles WHERE user_id=$1 AND NOT role=ANY($2)", userID, pq.Array(roles))
+	if err == nil {
+		_, err = tx.Exec("INSERT INTO user_roles(user_id, role) SELECT $1, unnest($2::text[]) ON CONFLICT DO NOTHING", userID, pq.Array(roles))
+	}
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return rbErr
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+const organizationColumns = "o.id, o.name, o.member_permission, m.role, o.created_at"
+
+func scanOrganization(row rowScanner) (organization, error) {
+	var o organization
+	err := row.Scan(&o.ID, &o.Name, &o.MemberPermission, &o.Role, &o.CreatedAt)
+	return o, err
+}
+
+func (s *storeImpl) createOrganization(userID, name string, memberPermission int) (organization, error) {
+	tx, err := s.Begin()
+	if err != nil {
+		return organization{}, err
+	}
+	o := organization{Name: name, MemberPermission: memberPermission, Role: orgRoleOwner}
+	err = tx.QueryRow("INSERT INTO organizations(name, member_permission) VALUES($1, $2) RETURNING id, created_at", name, memberPermission).Scan(&o.ID, &o.CreatedAt)
+	if err == nil {
+		_, err = tx.Exec("INSERT INTO organization_members(organization_id, user_id, role) VALUES($1, $2, $3)", o.ID, userID, orgRoleOwner)
+	}
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return organization{}, rbErr
+		}
+		return organization{}, err
+	}
+	return o, tx.Commit()
+}
+
+func (s *storeImpl) listOrganizations(userID string) ([]organization, error) {
+	rows, err := s.Query("SELECT "+organizationColumns+" FROM organizations o JOIN organization_members m ON m.organization_id=o.id WHERE m.user_id=$1 ORDER BY lower(o.name), o.id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orgs := []organization{}
+	for rows.Next() {
+		o, err := scanOrganization(rows)
+		if err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, o)
+	}
+	return orgs, rows.Err()
+}
+
+func (s *storeImpl) getOrganization(userID, orgID string) (organization, error) {
+	return scanOrganization(s.QueryRow("SELECT "+organizationColumns+" FROM organizations o JOIN organization_members m ON m.organization_id=o.id WHERE m.user_id=$1 AND o.id=$2", userID, orgID))
+}
+
+func (s *storeImpl) listOrganizationMembers(userID, orgID string) ([]organizationMember, error) {
+	rows, err := s.Query(`SELECT m.user_id, u.username, m.role, m.created_at
+		FROM organization_members m JOIN users u ON u.id=m.user_id
+		WHERE m.organization_id=$2 AND EXISTS (SELECT 1 FROM organization_members WHERE organization_id=$2 AND user_id=$1)
+		ORDER BY lower(u.username)`, userID, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []organizationMember{}
+	for rows.Next() {
+		var m organizationMember
+		if err := rows.Scan(&m.UserID, &m.Username, &m.Role, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// execScoped runs a statement scoped to what the user can change and returns
+// sql.ErrNoRows when it didn't affect any rows.
+func (s *storeImpl) execScoped(query string, args ...interface{}) error {
+	res, err := s.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// changeOrganizationMember sets the role of the member, or removes them when
+// role is empty. The members are locked while checkMemberChange runs so that
+// concurrent changes can't leave the organization without an owner.
+func (s *storeImpl) changeOrganizationMember(userID, orgID, memberID, role string) (organizationMember, error) {
+	tx, err := s.Begin()
+	if err != nil {
+		return organizationMember{}, err
+	}
+
+	m, err := func() (organizationMember, error) {
+		rows, err := tx.Query(`SELECT m.user_id, u.username, m.role, m.created_at
+			FROM organization_members m JOIN users u ON u.id=m.user_id
+			WHERE m.organization_id=$1 ORDER BY m.user_id FOR UPDATE OF m`, orgID)
+		if err != nil {
+			return organizationMember{}, err
+		}
+		members := []organizationMember{}
+		for rows.Next() {
+			var m organizationMember
+			if err := rows.Scan(&m.UserID, &m.Username, &m.Role, &m.CreatedAt); err != nil {
+				rows.Close()
+				return organizationMember{}, err
+			}
+			members = append(members, m)
+		}
+		if err := rows.Err(); err != nil {
+			return organizationMember{}, err
+		}
+
+		m, err := checkMemberChange(userID, memberID, role, members)
+		if err != nil {
+			return m, err
+		}
+		if role == "" {
+			_, err = tx.Exec("DELETE FROM organization_members WHERE organization_id=$1 AND user_id=$2", orgID, memberID)
+		} else {
+			_, err = tx.Exec("UPDATE organization_members SET role=$3 WHERE organization_id=$1 AND user_id=$2", orgID, memberID, role)
+			m.Role = role
+		}
+		return m, err
+	}()
+	if err != nil {
+		tx.Rollback()
+		return organizationMember{}, err
+	}
+	return m, tx.Commit()
+}
+
+// setListOrganization only moves lists the user owns or manages through
+// their current organization, and only into organizations they manage.
+func (s *storeImpl) setListOrganization(userID, listID string, orgID sql.NullString) error {
+	return s.execScoped(`UPDATE lists SET organization_id=$3 WHERE id=$2
+		AND (owner=$1 OR EXISTS (SELECT 1 FROM organization_members WHERE organization_id=lists.organization_id AND user_id=$1 AND role IN ('owner', 'admin')))
+		AND ($3::uuid IS NULL OR EXISTS (SELECT 1 FROM organization_members WHERE organization_id=$3 AND user_id=$1 AND role IN ('owner', 'admin')))`,
+		userID, listID, orgID)
+}
+
+const invitationColumns = `id, organization_id, (SELECT name FROM organizations WHERE organizations.id=organization_invitations.organization_id),
+	invited_by, invitee_user_id, invitee_email, role, status, expires_at, created_at`
+
+func scanInvitation(row rowScanner) (organizationInvitation, error) {
+	var inv organizationInvitation
+	err := row.Scan(&inv.ID, &inv.OrganizationID, &inv.OrganizationName, &inv.InvitedBy, &inv.InviteeUserID, &inv.InviteeEmail, &inv.Role, &inv.Status, &inv.ExpiresAt, &inv.CreatedAt)
+	return inv, err
+}
+
+// createOrganizationInvitation only invites on behalf of owners and admins
+// and returns errAlreadyMember when the invitee already is one.
+func (s *storeImpl) createOrganizationInvitation(userID string, inv organizationInvitation) (organizationInvitation, error) {
+	if inv.InviteeUserID.Valid {
+		var member bool
+		err := s.QueryRow(`SELECT EXISTS (SELECT 1 FROM organization_members WHERE organization_id=$1 AND user_id=$2)
+			AND EXISTS (SELECT 1 FROM organization_members WHERE organization_id=$1 AND user_id=$3)`, inv.OrganizationID, inv.InviteeUserID, userID).Scan(&member)
+		if err != nil {
+			return organizationInvitation{}, err
+		}
+		if member {
+			return organizationInvitation{}, errAlreadyMember
+		}
+	}
+	return scanInvitation(s.QueryRow(`INSERT INTO organization_invitations(organization_id, invited_by, invitee_user_id, invitee_email, role, expires_at)
+		SELECT $1, $2, $3, $4, $5, $6
+		WHERE EXISTS (SELECT 1 FROM organization_members WHERE organization_id=$1 AND user_id=$2 AND role IN ('owner', 'admin'))
+		RETURNING `+invitationColumns, inv.OrganizationID, userID, inv.InviteeUserID, inv.InviteeEmail, inv.Role, inv.ExpiresAt))
+}
+
+// invitedCondition matches invitations addressed to the user $1, either by id
+// or by their email once it's verified.
+const invitedCondition = `(invitee_user_id=$1 OR lower(invitee_email)=(SELECT lower(email) FROM users WHERE id=$1 AND email_verified_at IS NOT NULL))`
+
+func (s *storeImpl) listInvitations(userID string) ([]organizationInvitation, error) {
+	rows, err := s.Query("SELECT "+invitationColumns+" FROM organization_invitations WHERE status='pending' AND expires_at > now() AND "+invitedCondition+" ORDER BY created_at", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := []organizationInvitation{}
+	for rows.Next() {
+		inv, err := scanInvitation(rows)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, inv)
+	}
+	return invitations, rows.Err()
+}
+
+// respondToInvitation returns sql.ErrNoRows for invitations that aren't
+// addressed to the user, expired or were already answered.
+func (s *storeImpl) respondToInvitation(userID, invitationID string, accept bool) (organizationInvitation, error) {
+	status := invitationStatusDeclined
+	if accept {
+		status = invitationStatusAccepted
+	}
+
+	tx, err := s.Begin()
+	if err != nil {
+		return organizationInvitation{}, err
+	}
+	inv, err := scanInvitation(tx.QueryRow(`UPDATE organization_invitations SET status=$3, responded_at=now()
+		WHERE id=$2 AND status='pending' AND expires_at > now() AND `+invitedCondition+`
+		RETURNING `+invitationColumns, userID, invitationID, status))
+	if err == nil && accept {
+		_, err = tx.Exec(`INSERT INTO organization_members(organization_id, user_id, role) VALUES($1, $2, $3)
+			ON CONFLICT (organization_id, user_id) DO NOTHING`, inv.OrganizationID, userID, inv.Role)
+	}
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return organizationInvitation{}, rbErr
+		}
+		return organizationInvitation{}, err
+	}
+	return inv, tx.Commit()
+}
+
+// canShareListCondition matches when the user $1 owns the list $2 or is an
+// owner or admin of the organization owning it.
+const canShareListCondition = `EXISTS (SELECT 1 FROM lists l WHERE l.id=$2 AND (l.owner=$1 OR EXISTS (
+	SELECT 1 FROM organization_members m WHERE m.organization_id=l.organization_id AND m.user_id=$1 AND m.role IN ('owner', 'admin'))))`
+
+// grantListPermission never downgrades a permission the user already has.
+const grantListPermission = `INSERT INTO permissions(user_id, list_id, type) VALUES($1, $2, $3)
+	ON CONFLICT (user_id, list_id) DO UPDATE SET type=GREATEST(permissions.type, EXCLUDED.type)`
+
+const listInvitationColumns = `id, list_id, (SELECT name FROM lists WHERE lists.id=list_invitations.list_id),
+	invited_by, invitee_user_id, invitee_email, permission, status, expires_at, created_at`
+
+func scanListInvitation(row rowScanner) (listInvitation, error) {
+	var inv listInvitation
+	err := row.Scan(&inv.ID, &inv.ListID, &inv.ListName, &inv.InvitedBy, &inv.InviteeUserID, &inv.InviteeEmail, &inv.Permission, &inv.Status, &inv.ExpiresAt, &inv.CreatedAt)
+	return inv, err
+}
+
+// createListInvitation returns errAlreadyCollaborator when the invitee can
+// already reach the list.
+func (s *storeImpl) createListInvitation(userID string, inv listInvitation) (listInvitation, error) {
+	if inv.InviteeUserID.Valid {
+		var collaborator bool
+		err := s.QueryRow("SELECT "+canShareListCondition+" AND EXISTS (SELECT 1 FROM list_access WHERE list_id=$2 AND user_id=$3)",
+			userID, inv.ListID, inv.InviteeUserID).Scan(&collaborator)
+		if err != nil {
+			return listInvitation{}, err
+		}
+		if collaborator {
+			return listInvitation{}, errAlreadyCollaborator
+		}
+	}
+	return scanListInvitation(s.QueryRow(`INSERT INTO list_invitations(invited_by, list_id, invitee_user_id, invitee_email, permission, expires_at)
+		SELECT $1, $2, $3, $4, $5, $6 WHERE `+canShareListCondition+`
+		RETURNING `+listInvitationColumns, userID, inv.ListID, inv.InviteeUserID, inv.InviteeEmail, inv.Permission, inv.ExpiresAt))
+}
+
+func (s *storeImpl) listListInvitations(userID string) ([]listInvitation, error) {
+	rows, err := s.Query("SELECT "+listInvitationColumns+" FROM list_invitations WHERE status='pending' AND expires_at > now() AND "+invitedCondition+" ORDER BY created_at", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := []listInvitation{}
+	for rows.Next() {
+		inv, err := scanListInvitation(rows)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, inv)
+	}
+	return invitations, rows.Err()
+}
+
+// respondToListInvitation returns sql.ErrNoRows for invitations that aren't
+// addressed to the user, expired or were already answered.
+func (s *storeImpl) respondToListInvitation(userID, invitationID string, accept bool) (listInvitation, error) {
+	status := invitationStatusDeclined
+	if accept {
+		status = invitationStatusAccepted
+	}
+
+	tx, err := s.Begin()
+	if err != nil {
+		return listInvitation{}, err
+	}
+	inv, err := scanListInvitation(tx.QueryRow(`UPDATE list_invitations SET status=$3, responded_at=now()
+		WHERE id=$2 AND status='pending' AND expires_at > now() AND `+invitedCondition+`
+		RETURNING `+listInvitationColumns, userID, invitationID, status))
+	if err == nil && accept {
+		_, err = tx.Exec(grantListPermission, userID, inv.ListID, inv.Permission)
+	}
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return listInvitation{}, rbErr
+		}
+		return listInvitation{}, err
+	}
+	return inv, tx.Commit()
+}
+
+const shareLinkColumns = "id, list_id, permission, created_by, expires_at, created_at"
+
+func scanShareLink(row rowScanner) (shareLink, error) {
+	var link shareLink
+	err := row.Scan(&link.ID, &link.ListID, &link.Permission, &link.CreatedBy, &link.ExpiresAt, &link.CreatedAt)
+	return link, err
+}
+
+func (s *storeImpl) createShareLink(userID string, link shareLink, tokenHash string) (shareLink, error) {
+	return scanShareLink(s.QueryRow(`INSERT INTO list_share_links(created_by, list_id, permission, expires_at, token_hash)
+		SELECT $1, $2, $3, $4, $5 WHERE `+canShareListCondition+`
+		RETURNING `+shareLinkColumns, userID, link.ListID, link.Permission, link.ExpiresAt, tokenHash))
+}
+
+func (s *storeImpl) revokeShareLink(userID, listID, linkID string) error {
+	return s.execScoped(`UPDATE list_share_links SET revoked_at=now() WHERE list_id=$2 AND id=$3 AND revoked_at IS NULL AND `+canShareListCondition,
+		userID, listID, linkID)
+}
+
+// redeemShareLink returns sql.ErrNoRows for unknown, expired or revoked
+// links.
+func (s *storeImpl) redeemShareLink(userID, tokenHash string) (shareLink, error) {
+	tx, err := s.Begin()
+	if err != nil {
+		return shareLink{}, err
+	}
+	link, err := scanShareLink(tx.QueryRow("SELECT "+shareLinkColumns+" FROM list_share_links WHERE token_hash=$1 AND revoked_at IS NULL AND expires_at > now()", tokenHash))
+	if err == nil {
+		_, err = tx.Exec(grantListPermission, userID, link.ListID, link.Permission)
+	}
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return shareLink{}, rbErr
+		}
+		return shareLink{}, err
+	}
+	return link, tx.Commit()
+}
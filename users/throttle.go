@@ -0,0 +1,197 @@
+package users
+
+import (
+	"database/sql"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// maxLoginFailures failed logins within loginFailureWindow lock the
+	// username or client IP out.
+	maxLoginFailures   = 5
+	loginFailureWindow = 15 * time.Minute
+
+	// Each consecutive lockout doubles the previous one, starting at
+	// baseLockout and up to maxLockout. Lockouts are forgotten after
+	// lockoutMemory without failures.
+	baseLockout   = time.Minute
+	maxLockout    = time.Hour
+	lockoutMemory = 24 * time.Hour
+)
+
+const (
+	throttleKeyUsername = "username"
+	throttleKeyIP       = "ip"
+)
+
+type throttleKey struct {
+	Type  string
+	Value string
+}
+
+func (k throttleKey) String() string {
+	return k.Type + ":" + k.Value
+}
+
+type lockout struct {
+	Key         throttleKey
+	LockedUntil time.Time
+}
+
+// LoginThrottle counts failed logins per username and per client IP.
+type LoginThrottle interface {
+	lockedUntil(keys []throttleKey) (time.Time, error)
+	recordFailure(keys []throttleKey, now time.Time) ([]lockout, error)
+	reset(key throttleKey) error
+}
+
+type loginAttempts struct {
+	Failures      int
+	Lockouts      int
+	LastFailureAt time.Time
+	LockedUntil   time.Time
+}
+
+// registerFailure returns the state after a failed login at now and whether
+// that failure started a new lockout.
+func (a loginAttempts) registerFailure(now time.Time) (loginAttempts, bool) {
+	if now.Sub(a.LastFailureAt) > lockoutMemory {
+		a.Lockouts = 0
+	}
+	if now.Sub(a.LastFailureAt) > loginFailureWindow {
+		a.Failures = 0
+	}
+	a.Failures++
+	a.LastFailureAt = now
+	if a.Failures < maxLoginFailures {
+		return a, false
+	}
+	a.Failures = 0
+	a.Lockouts++
+	a.LockedUntil = now.Add(lockoutDuration(a.Lockouts))
+	return a, true
+}
+
+// expired tells whether the state is no different from having no failures
+// at all at now, so its row can be deleted.
+func (a loginAttempts) expired(now time.Time) bool {
+	return now.Sub(a.LastFailureAt) > lockoutMemory && !now.Before(a.LockedUntil)
+}
+
+func lockoutDuration(lockouts int) time.Duration {
+	d := baseLockout
+	for i := 1; i < lockouts && d < maxLockout; i++ {
+		d *= 2
+	}
+	if d > maxLockout {
+		return maxLockout
+	}
+	return d
+}
+
+// clientIP relies on the X-Real-IP header set by Kong since the service is
+// only reachable through the gateway.
+func clientIP(r *http.Request) string {
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); ip != "" {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+type loginThrottleImpl struct {
+	*sql.DB
+}
+
+func NewLoginThrottle(db *sql.DB) LoginThrottle {
+	return &loginThrottleImpl{db}
+}
+
+func throttleKeyStrings(keys []throttleKey) []string {
+	s := make([]string, len(keys))
+	for i, k := range keys {
+		s[i] = k.String()
+	}
+	return s
+}
+
+func (t *loginThrottleImpl) lockedUntil(keys []throttleKey) (time.Time, error) {
+	var lockedUntil pq.NullTime
+	row := t.QueryRow("SELECT max(locked_until) FROM login_attempts WHERE key = ANY($1)", pq.Array(throttleKeyStrings(keys)))
+	if err := row.Scan(&lockedUntil); err != nil {
+		return time.Time{}, err
+	}
+	return lockedUntil.Time, nil
+}
+
+func (t *loginThrottleImpl) recordFailure(keys []throttleKey, now time.Time) ([]lockout, error) {
+	tx, err := t.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	handleError := func(tx *sql.Tx, err error) error {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return rbErr
+		}
+		return err
+	}
+
+	// Clean up expired rows on write since a row is added for every username
+	// tried, including unknown ones.
+	if _, err := tx.Exec(
+		"DELETE FROM login_attempts WHERE last_failure_at < $1 AND (locked_until IS NULL OR locked_until <= $2)",
+		now.Add(-lockoutMemory), now,
+	); err != nil {
+		return nil, handleError(tx, err)
+	}
+
+	var lockouts []lockout
+	for _, key := range keys {
+		if _, err := tx.Exec("INSERT INTO login_attempts(key, last_failure_at) VALUES($1, $2) ON CONFLICT DO NOTHING", key.String(), now); err != nil {
+			return nil, handleError(tx, err)
+		}
+
+		var (
+			a           loginAttempts
+			lockedUntil pq.NullTime
+		)
+		row := tx.QueryRow("SELECT failures, lockouts, last_failure_at, locked_until FROM login_attempts WHERE key=$1 FOR UPDATE", key.String())
+		if err := row.Scan(&a.Failures, &a.Lockouts, &a.LastFailureAt, &lockedUntil); err != nil {
+			return nil, handleError(tx, err)
+		}
+		a.LockedUntil = lockedUntil.Time
+
+		a, lockedOut := a.registerFailure(now)
+		if lockedOut {
+			lockouts = append(lockouts, lockout{Key: key, LockedUntil: a.LockedUntil})
+		}
+
+		if _, err := tx.Exec(
+			"UPDATE login_attempts SET failures=$1, lockouts=$2, last_failure_at=$3, locked_until=$4 WHERE key=$5",
+			a.Failures, a.Lockouts, a.LastFailureAt, pq.NullTime{Time: a.LockedUntil, Valid: !a.LockedUntil.IsZero()}, key.String(),
+		); err != nil {
+			return nil, handleError(tx, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return lockouts, nil
+}
+
+func (t *loginThrottleImpl) reset(key throttleKey) error {
+	if _, err := t.Exec("DELETE FROM login_attempts WHERE key=$1", key.String()); err != nil {
+		return err
+	}
+	return nil
+}
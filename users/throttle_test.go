@@ -0,0 +1,91 @@
+package users
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginAttemptsRegisterFailure(t *testing.T) {
+	var (
+		now       = time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC)
+		a         loginAttempts
+		lockedOut bool
+	)
+
+	for i := 1; i < maxLoginFailures; i++ {
+		if a, lockedOut = a.registerFailure(now); lockedOut {
+			t.Fatalf("unexpected lockout after %d failures", i)
+		}
+	}
+	if a, lockedOut = a.registerFailure(now); !lockedOut || !a.LockedUntil.Equal(now.Add(baseLockout)) {
+		t.Fatalf("expected %v lockout, got %v", baseLockout, a.LockedUntil.Sub(now))
+	}
+
+	for i := 0; i < maxLoginFailures; i++ {
+		a, lockedOut = a.registerFailure(now)
+	}
+	if !lockedOut || !a.LockedUntil.Equal(now.Add(2*baseLockout)) {
+		t.Errorf("expected second lockout to double, got %v", a.LockedUntil.Sub(now))
+	}
+
+	a, _ = a.registerFailure(now.Add(loginFailureWindow + time.Second))
+	if a.Failures != 1 || a.Lockouts != 2 {
+		t.Errorf("expected failures to reset after window, got %+v", a)
+	}
+
+	a, _ = a.registerFailure(now.Add(lockoutMemory + 2*loginFailureWindow))
+	if a.Lockouts != 0 {
+		t.Errorf("expected lockouts to be forgotten, got %+v", a)
+	}
+}
+
+func TestLoginAttemptsExpired(t *testing.T) {
+	now := time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := map[string]struct {
+		attempts loginAttempts
+		expired  bool
+	}{
+		"recent failure": {
+			attempts: loginAttempts{Failures: 1, LastFailureAt: now.Add(-time.Minute)},
+		},
+		"lockouts still remembered": {
+			attempts: loginAttempts{Lockouts: 3, LastFailureAt: now.Add(-lockoutMemory + time.Minute)},
+		},
+		"still locked out": {
+			attempts: loginAttempts{Lockouts: 1, LastFailureAt: now.Add(-lockoutMemory - time.Minute), LockedUntil: now.Add(time.Minute)},
+		},
+		"forgotten": {
+			attempts: loginAttempts{Failures: 2, Lockouts: 3, LastFailureAt: now.Add(-lockoutMemory - time.Minute), LockedUntil: now.Add(-lockoutMemory)},
+			expired:  true,
+		},
+	}
+
+	for td, tt := range tests {
+		if expired := tt.attempts.expired(now); expired != tt.expired {
+			t.Errorf("%v: expected expired %v, got %v", td, tt.expired, expired)
+		}
+		if !tt.expired {
+			continue
+		}
+		// An expired row must behave like a missing one.
+		a, _ := tt.attempts.registerFailure(now)
+		fresh, _ := loginAttempts{}.registerFailure(now)
+		if a.Failures != fresh.Failures || a.Lockouts != fresh.Lockouts {
+			t.Errorf("%v: expected %+v after a failure, got %+v", td, fresh, a)
+		}
+	}
+}
+
+func TestLockoutDuration(t *testing.T) {
+	tests := map[int]time.Duration{
+		1:   baseLockout,
+		2:   2 * baseLockout,
+		3:   4 * baseLockout,
+		100: maxLockout,
+	}
+	for lockouts, expected := range tests {
+		if d := lockoutDuration(lockouts); d != expected {
+			t.Errorf("lockout %d: expected %v, got %v", lockouts, expected, d)
+		}
+	}
+}
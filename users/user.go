@@ -0,0 +1,50 @@
+package users
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/diorman/todospoc"
+	"github.com/lib/pq"
+)
+
+// The pending, active and failed statuses are the values of the
+// provisioning_status column, disabled takes precedence over them.
+const (
+	userStatusPending  = "pending"
+	userStatusActive   = "active"
+	userStatusFailed   = "failed"
+	userStatusDisabled = "disabled"
+)
+
+type user struct {
+	ID                 string
+	Username           string
+	ConsumerID         sql.NullString
+	ProvisioningStatus string
+	Email              sql.NullString
+	EmailVerifiedAt    pq.NullTime
+	CreatedAt          time.Time
+	DisabledAt         pq.NullTime
+	Roles              []string
+}
+
+// awaitingVerification reports whether provisioning is withheld until the
+// user verifies their email. Users without an email are never held back.
+func (u user) awaitingVerification() bool {
+	return todospoc.Config.RequireEmailVerification && u.Email.Valid && !u.EmailVerifiedAt.Valid
+}
+
+func (u user) status() string {
+	if u.DisabledAt.Valid {
+		return userStatusDisabled
+	}
+	return u.ProvisioningStatus
+}
+
+type userFilter struct {
+	UsernamePrefix string
+	Status         string
+	After          string
+	Limit          int
+}
@@ -0,0 +1,85 @@
+package users
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/diorman/todospoc/utils"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	usernameMinLength = 3
+	usernameMaxLength = 32
+	emailMaxLength    = 254
+)
+
+var reservedUsernames = map[string]bool{
+	"_hc":           true,
+	"admin":         true,
+	"administrator": true,
+	"api":           true,
+	"login":         true,
+	"me":            true,
+	"root":          true,
+	"support":       true,
+	"system":        true,
+	"users":         true,
+}
+
+// normalizeUsername folds compatibility characters (e.g. fullwidth letters)
+// into their canonical form so that visually identical usernames compare equal.
+func normalizeUsername(username string) string {
+	return strings.TrimSpace(norm.NFKC.String(username))
+}
+
+func validateUsername(username string) error {
+	var message string
+	switch length := utf8.RuneCountInString(username); {
+	case length == 0:
+		message = "username can't be empty"
+	case length < usernameMinLength:
+		message = fmt.Sprintf("username must be at least %d characters long", usernameMinLength)
+	case length > usernameMaxLength:
+		message = fmt.Sprintf("username must be at most %d characters long", usernameMaxLength)
+	case !isValidUsernameCharset(username):
+		message = "username may only contain letters, digits, '.', '_' and '-' and must start with a letter or digit"
+	case reservedUsernames[strings.ToLower(username)]:
+		message = "username is reserved"
+	default:
+		return nil
+	}
+	return utils.ValidationError{{Field: "username", Message: message}}
+}
+
+func isValidUsernameCharset(username string) bool {
+	for i, c := range username {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case i > 0 && (c == '.' || c == '_' || c == '-'):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func normalizeEmail(email string) string {
+	return strings.TrimSpace(email)
+}
+
+// validateEmail only accepts bare addresses, names and angle brackets that
+// net/mail would otherwise parse are rejected.
+func validateEmail(email string) error {
+	var message string
+	if len(email) > emailMaxLength {
+		message = fmt.Sprintf("email must be at most %d characters long", emailMaxLength)
+	} else if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+		message = "email is not a valid address"
+	} else {
+		return nil
+	}
+	return utils.ValidationError{{Field: "email", Message: message}}
+}
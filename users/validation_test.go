@@ -0,0 +1,64 @@
+package users
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateUsername(t *testing.T) {
+	tests := map[string]struct {
+		username string
+		valid    bool
+	}{
+		"accepts letters, digits and separators":  {"john.doe_99-x", true},
+		"accepts mixed case":                      {"JohnDoe", true},
+		"rejects empty username":                  {"", false},
+		"rejects too short username":              {"ab", false},
+		"rejects too long username":               {strings.Repeat("a", usernameMaxLength+1), false},
+		"rejects control characters":              {"john\x00doe", false},
+		"rejects emoji":                           {"john😀", false},
+		"rejects leading separator":               {"_john", false},
+		"rejects reserved username":               {"admin", false},
+		"rejects reserved username ignoring case": {"ROOT", false},
+	}
+
+	for td, tt := range tests {
+		err := validateUsername(tt.username)
+		if tt.valid && err != nil {
+			t.Errorf("%v: unexpected error: %v", td, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("%v: expected validation error", td)
+		}
+	}
+}
+
+func TestNormalizeUsername(t *testing.T) {
+	if username := normalizeUsername(" ｊｏｈｎ "); username != "john" {
+		t.Errorf("unexpected normalized username: %v", username)
+	}
+}
+
+func TestValidateEmail(t *testing.T) {
+	tests := map[string]struct {
+		email string
+		valid bool
+	}{
+		"accepts plain address":      {"john@example.com", true},
+		"rejects missing domain":     {"john@", false},
+		"rejects missing at sign":    {"john.example.com", false},
+		"rejects display name":       {"John <john@example.com>", false},
+		"rejects too long address":   {strings.Repeat("a", emailMaxLength) + "@example.com", false},
+		"rejects multiple addresses": {"john@example.com, jane@example.com", false},
+	}
+
+	for td, tt := range tests {
+		err := validateEmail(tt.email)
+		if tt.valid && err != nil {
+			t.Errorf("%v: unexpected error: %v", td, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("%v: expected validation error", td)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/diorman/todospoc"
+	"github.com/diorman/todospoc/logging"
+	"github.com/diorman/todospoc/mail"
+	"github.com/diorman/todospoc/utils"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const verificationTokenTTL = 24 * time.Hour
+
+// newOneTimeToken returns a random token to be emailed and the hash that is
+// stored in its place.
+func newOneTimeToken() (string, string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	return token, hashToken(token), nil
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("could not generate token: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (h Handler) sendVerificationEmail(u user) error {
+	token, tokenHash, err := newOneTimeToken()
+	if err != nil {
+		return err
+	}
+	if err := h.store.createVerificationToken(u.ID, tokenHash, time.Now().Add(verificationTokenTTL)); err != nil {
+		return fmt.Errorf("could not save verification token: %v", err)
+	}
+	return h.mailer.Send(mail.Message{
+		To:      u.Email.String,
+		Subject: "Verify your email",
+		Body: fmt.Sprintf("Hi %s,\n\nUse the following token to verify your email, it expires in %v:\n\n%s\n",
+			u.Username, verificationTokenTTL, token),
+	})
+}
+
+// emailVerifiedByOther reports whether another account owns the email of u,
+// it couldn't be verified so there's no point in emailing a token.
+func (h Handler) emailVerifiedByOther(r *http.Request, u user) bool {
+	owner, err := h.store.getUserByEmail(u.Email.String)
+	if err != nil && err != sql.ErrNoRows {
+		logging.FromContext(r.Context()).Errorf("%v", err)
+	}
+	return err == nil && owner.ID != u.ID && owner.EmailVerifiedAt.Valid
+}
+
+func (h Handler) handleVerifyEmail() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		requestBody := struct {
+			Token string `json:"token"`
+		}{}
+
+		if err := utils.DecodeJSON(w, r, &requestBody); err != nil {
+			utils.WriteProblem(w, r, err)
+			return
+		}
+		if requestBody.Token == "" {
+			utils.WriteProblem(w, r, utils.ValidationError{{Field: "token", Message: "token can't be empty"}})
+			return
+		}
+
+		// users held back by RequireEmailVerification are provisioned now,
+		// the event is harmless for users that already were.
+		userID, err := h.store.verifyEmail(hashToken(requestBody.Token), func(userID string) error {
+			if !todospoc.Config.RequireEmailVerification {
+				return nil
+			}
+			e, err := newEvent(userCreatedEvent, logging.RequestID(r.Context()), userCreatedPayload{UserID: userID})
+			if err != nil {
+				return err
+			}
+			return h.sqs.SendMessage(todospoc.Config.UserEventsQueueName, e)
+		})
+
+		if err == sql.ErrNoRows {
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusBadRequest, "invalid_token", "token is invalid or has expired"))
+			return
+		}
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+
+		response := struct {
+			ID            string `json:"id"`
+			EmailVerified bool   `json:"email_verified"`
+		}{userID, true}
+
+		utils.WriteJSON(w, http.StatusOK, response)
+	}
+}
+
+// handleResendVerification always answers 202 so it can't be used to find out
+// which emails are registered.
+func (h Handler) handleResendVerification() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		requestBody := struct {
+			Email string `json:"email"`
+		}{}
+
+		if err := utils.DecodeJSON(w, r, &requestBody); err != nil {
+			utils.WriteProblem(w, r, err)
+			return
+		}
+		email := normalizeEmail(requestBody.Email)
+		if err := validateEmail(email); err != nil {
+			utils.WriteProblem(w, r, err)
+			return
+		}
+
+		u, err := h.store.getUserByEmail(email)
+		if err != nil && err != sql.ErrNoRows {
+			logging.FromContext(r.Context()).Errorf("%v", err)
+			utils.WriteProblem(w, r, err)
+			return
+		}
+		if err == nil && !u.EmailVerifiedAt.Valid && !u.DisabledAt.Valid {
+			if err := h.sendVerificationEmail(u); err != nil {
+				logging.FromContext(r.Context()).With(logging.Fields{"user_id": u.ID}).Errorf("%v", err)
+			}
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
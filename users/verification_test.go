@@ -0,0 +1,197 @@
+package users
+
+import (
+	"bytes"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diorman/todospoc"
+	"github.com/julienschmidt/httprouter"
+	"github.com/lib/pq"
+)
+
+var testVerifiedUser = user{
+	ID:                 testUser.ID,
+	Username:           testUser.Username,
+	ConsumerID:         testUser.ConsumerID,
+	ProvisioningStatus: testUser.ProvisioningStatus,
+	Email:              sql.NullString{String: "user@example.com", Valid: true},
+	EmailVerifiedAt:    pq.NullTime{Time: time.Date(2018, 5, 2, 0, 0, 0, 0, time.UTC), Valid: true},
+	CreatedAt:          testUser.CreatedAt,
+	Roles:              testUser.Roles,
+}
+
+var testUnverifiedUser = user{
+	ID:                 testUser.ID,
+	Username:           testUser.Username,
+	Email:              sql.NullString{String: "user@example.com", Valid: true},
+	ProvisioningStatus: userStatusPending,
+	CreatedAt:          testUser.CreatedAt,
+	Roles:              testUser.Roles,
+}
+
+func requireEmailVerification() func() {
+	required := todospoc.Config.RequireEmailVerification
+	todospoc.Config.RequireEmailVerification = true
+	return func() { todospoc.Config.RequireEmailVerification = required }
+}
+
+func TestHandleCreateUserWithEmail(t *testing.T) {
+	defer requireEmailVerification()()
+
+	s := testStore{}
+	s.saveUserReturn.userID = "123"
+	sqsClient := testSQSClient{}
+	mailer := testMailer{}
+
+	h := NewHandler(httprouter.New(), &s, &testKongClient{}, &sqsClient, &testLoginThrottle{}, &mailer, nil)
+	r, _ := http.NewRequest("POST", "/users", bytes.NewBuffer([]byte(`{"username": "user-123", "email": "user@example.com"}`)))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	expected := `{"id":"123","username":"user-123","email":"user@example.com","status":"pending"}`
+	if w.Code != http.StatusCreated || w.Body.String() != expected {
+		t.Errorf("unexpected response: %v %v", w.Code, w.Body.String())
+	}
+	if len(sqsClient.sentMessages) != 0 {
+		t.Errorf("expected provisioning to be withheld until verification")
+	}
+	if len(s.verificationTokens) != 1 || len(mailer.sent) != 1 || mailer.sent[0].To != "user@example.com" {
+		t.Fatalf("expected a verification email to be sent")
+	}
+	if body := mailer.sent[0].Body; strings.Contains(body, s.verificationTokens[0]) {
+		t.Errorf("expected the emailed token not to be the stored hash")
+	}
+}
+
+func TestHandleCreateUserWithEmailOfAnotherAccount(t *testing.T) {
+	s := testStore{}
+	s.saveUserReturn.userID = "123"
+	s.getUserByEmailReturn.user = testVerifiedUser
+	mailer := testMailer{}
+
+	h := NewHandler(httprouter.New(), &s, &testKongClient{}, &testSQSClient{}, &testLoginThrottle{}, &mailer, nil)
+	r, _ := http.NewRequest("POST", "/users", bytes.NewBuffer([]byte(`{"username": "user-123", "email": "user@example.com"}`)))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	expected := `{"id":"123","username":"user-123","email":"user@example.com","status":"pending"}`
+	if w.Code != http.StatusCreated || w.Body.String() != expected {
+		t.Errorf("unexpected response: %v %v", w.Code, w.Body.String())
+	}
+	if len(s.verificationTokens) != 0 || len(mailer.sent) != 0 {
+		t.Errorf("expected no verification email for an email verified by another account")
+	}
+}
+
+func TestHandleVerifyEmail(t *testing.T) {
+	defer requireEmailVerification()()
+
+	tests := map[string]struct {
+		requestBody     string
+		statusCode      int
+		responseBody    string
+		storeVerifyErr  error
+		provisionEvents int
+	}{
+		"returns 200 and provisions the user when token is valid": {
+			requestBody:     `{"token": "abc"}`,
+			statusCode:      http.StatusOK,
+			responseBody:    `{"id":"123","email_verified":true}`,
+			provisionEvents: 1,
+		},
+		"returns 400 when token is invalid or expired": {
+			requestBody:    `{"token": "abc"}`,
+			statusCode:     http.StatusBadRequest,
+			responseBody:   `{"type":"about:blank","title":"Bad Request","status":400,"detail":"token is invalid or has expired","instance":"/users/verify","code":"invalid_token"}`,
+			storeVerifyErr: sql.ErrNoRows,
+		},
+		"returns 400 when token is empty": {
+			requestBody:  `{}`,
+			statusCode:   http.StatusBadRequest,
+			responseBody: `{"type":"about:blank","title":"Bad Request","status":400,"detail":"request has invalid fields","instance":"/users/verify","code":"validation_failed","errors":[{"field":"token","message":"token can't be empty"}]}`,
+		},
+	}
+
+	for td, tt := range tests {
+		s := testStore{}
+		s.verifyEmailReturn.userID = "123"
+		s.verifyEmailReturn.err = tt.storeVerifyErr
+		sqsClient := testSQSClient{}
+
+		h := NewHandler(httprouter.New(), &s, &testKongClient{}, &sqsClient, &testLoginThrottle{}, &testMailer{}, nil)
+		r, _ := http.NewRequest("POST", "/users/verify", bytes.NewBuffer([]byte(tt.requestBody)))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if tt.statusCode != w.Code {
+			t.Errorf("%v: handler returned wrong status code: expected %v, got %v", td, tt.statusCode, w.Code)
+		}
+
+		if tt.responseBody != w.Body.String() {
+			t.Errorf("%v: handler returned wrong body: expected %v, got %v", td, tt.responseBody, w.Body.String())
+		}
+
+		if len(sqsClient.sentMessages) != tt.provisionEvents {
+			t.Errorf("%v: wrong number of events: expected %v, got %v", td, tt.provisionEvents, len(sqsClient.sentMessages))
+		}
+	}
+}
+
+func TestHandleResendVerification(t *testing.T) {
+	tests := map[string]struct {
+		storeUser    user
+		storeUserErr error
+		sentEmails   int
+	}{
+		"sends a new email to unverified users": {
+			storeUser:  testUnverifiedUser,
+			sentEmails: 1,
+		},
+		"does not reveal unknown emails": {
+			storeUserErr: sql.ErrNoRows,
+			sentEmails:   0,
+		},
+	}
+
+	for td, tt := range tests {
+		s := testStore{}
+		s.getUserByEmailReturn.user = tt.storeUser
+		s.getUserByEmailReturn.err = tt.storeUserErr
+		mailer := testMailer{}
+
+		h := NewHandler(httprouter.New(), &s, &testKongClient{}, &testSQSClient{}, &testLoginThrottle{}, &mailer, nil)
+		r, _ := http.NewRequest("POST", "/users/verify/resend", bytes.NewBuffer([]byte(`{"email": "user@example.com"}`)))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != http.StatusAccepted {
+			t.Errorf("%v: handler returned wrong status code: expected %v, got %v", td, http.StatusAccepted, w.Code)
+		}
+
+		if len(mailer.sent) != tt.sentEmails {
+			t.Errorf("%v: wrong number of emails: expected %v, got %v", td, tt.sentEmails, len(mailer.sent))
+		}
+	}
+}
+
+func TestHandleLoginUnverifiedEmail(t *testing.T) {
+	defer requireEmailVerification()()
+
+	s := testStore{}
+	s.getUserByUsernameReturn.user = testUnverifiedUser
+
+	h := NewHandler(httprouter.New(), &s, &testKongClient{}, &testSQSClient{}, &testLoginThrottle{}, &testMailer{}, nil)
+	r, _ := http.NewRequest("POST", "/login", bytes.NewBuffer([]byte(`{"username": "user-123"}`)))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	expected := `{"type":"about:blank","title":"Forbidden","status":403,"detail":"email has not been verified","instance":"/login","code":"email_not_verified"}`
+	if w.Code != http.StatusForbidden || w.Body.String() != expected {
+		t.Errorf("unexpected response: %v %v", w.Code, w.Body.String())
+	}
+}
@@ -1,20 +1,39 @@
 package users
 
 import (
-	"bytes"
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"runtime/debug"
+	"strconv"
+	"sync/atomic"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/diorman/todospoc/logging"
+	"github.com/diorman/todospoc/metrics"
 	"github.com/diorman/todospoc/utils"
 )
 
+// maxHeartbeatAge bounds how long a healthy worker can go without finishing a
+// poll or a message, it must be well above the receive wait time.
+const maxHeartbeatAge = 30 * time.Second
+
+// maxProvisioningAttempts is the number of deliveries of a user_created event
+// after which the user is marked as failed instead of retrying again.
+const maxProvisioningAttempts = 5
+
 type Worker struct {
 	sqs       utils.SQSClient
 	store     Store
 	kong      KongClient
 	queueName string
+	heartbeat int64
+	stop      chan struct{}
+	done      chan struct{}
 }
 
 func NewWorker(sqs utils.SQSClient, store Store, kong KongClient, queueName string) *Worker {
@@ -23,63 +42,215 @@ func NewWorker(sqs utils.SQSClient, store Store, kong KongClient, queueName stri
 		store:     store,
 		kong:      kong,
 		queueName: queueName,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
 	}
 }
 
 func (w *Worker) Start() {
+	defer close(w.done)
+	logger := logging.Default().With(logging.Fields{"queue": w.queueName})
 	for {
+		select {
+		case <-w.stop:
+			logger.Infof("worker stopped")
+			return
+		default:
+		}
+		w.beat()
 		msgs, err := w.sqs.ReceiveMessage(w.queueName, 10, 5)
 		if err != nil {
-			log.Printf("failed to read message: %v\n", err)
+			logger.Errorf("failed to read message: %v", err)
 			continue
 		}
 		if len(msgs) > 0 {
-			log.Printf("recived %d messages\n", len(msgs))
+			logger.Debugf("received %d messages", len(msgs))
+			metrics.WorkerMessagesReceived.WithLabelValues(w.queueName).Add(float64(len(msgs)))
 		}
 		for _, msg := range msgs {
-			userID, err := decodeUserCreatedMessage(msg)
-			if err != nil {
-				log.Println(err.Error())
-				continue
-			}
-			if err := w.setupKongConsumer(userID); err != nil {
-				log.Println(err.Error())
-				continue
-			}
-			if err := w.sqs.DeleteMessage(w.queueName, *msg.ReceiptHandle); err != nil {
-				log.Println(err.Error())
-				continue
-			}
-			log.Printf("message processed %s\n", *msg.Body)
+			w.processMessage(logger, msg)
+			w.beat()
 		}
 	}
 }
 
-func decodeUserCreatedMessage(message sqs.Message) (string, error) {
-	decoder := json.NewDecoder(bytes.NewBuffer([]byte(*message.Body)))
-	messageBody := struct {
-		EventType string `json:"event_type"`
-		Payload   struct {
-			UserID string `json:"user_id"`
-		} `json:"payload"`
-	}{}
-	if err := decoder.Decode(&messageBody); err != nil {
-		return "", fmt.Errorf("could not decode sqs message: %v", err)
+// Stop makes Start return once the batch being processed is done and waits
+// for it to happen.
+func (w *Worker) Stop() {
+	close(w.stop)
+	<-w.done
+}
+
+func (w *Worker) beat() {
+	atomic.StoreInt64(&w.heartbeat, time.Now().UnixNano())
+}
+
+// CheckHeartbeat fails when the worker loop has not started or has been stuck
+// for longer than maxHeartbeatAge.
+func (w *Worker) CheckHeartbeat(ctx context.Context) error {
+	last := atomic.LoadInt64(&w.heartbeat)
+	if last == 0 {
+		return errors.New("worker has not started")
 	}
-	if messageBody.EventType != "user_created" {
-		return "", fmt.Errorf("unexpected message: %s", messageBody)
+	if age := time.Since(time.Unix(0, last)); age > maxHeartbeatAge {
+		return fmt.Errorf("worker heartbeat is %v old", age.Round(time.Second))
 	}
-	return messageBody.Payload.UserID, nil
+	return nil
 }
 
-func (w *Worker) setupKongConsumer(userID string) error {
-	consumerID, err := w.kong.createConsumer(userID)
+func (w *Worker) processMessage(logger *logging.Logger, msg sqs.Message) {
+	defer func(start time.Time) {
+		metrics.WorkerProcessingDuration.WithLabelValues(w.queueName).Observe(time.Since(start).Seconds())
+	}(time.Now())
+
+	logger = logger.With(logging.Fields{"message_id": aws.StringValue(msg.MessageId)})
+	fail := func(stage string, err error) {
+		metrics.WorkerMessagesFailed.WithLabelValues(w.queueName, stage).Inc()
+		logger.Errorf("%v", err)
+	}
+
+	// the message is not deleted on panic so it will be redelivered once its
+	// visibility timeout expires.
+	defer func() {
+		if rcv := recover(); rcv != nil {
+			logger = logger.With(logging.Fields{"stack": string(debug.Stack())})
+			fail("panic", fmt.Errorf("recovered from panic processing message: %v", rcv))
+		}
+	}()
+
+	e, err := decodeEvent(msg)
 	if err != nil {
+		fail("decode", err)
+		return
+	}
+	logger = logger.With(logging.Fields{"request_id": e.RequestID, "event_type": e.EventType})
+	if err := w.handleEvent(logger, e, receiveCount(msg)); err != nil {
+		fail("handle", err)
+		return
+	}
+	if err := w.sqs.DeleteMessage(w.queueName, *msg.ReceiptHandle); err != nil {
+		fail("delete", err)
+		return
+	}
+	metrics.WorkerMessagesProcessed.WithLabelValues(w.queueName, e.EventType).Inc()
+	logger.Infof("message processed")
+}
+
+func decodeEvent(message sqs.Message) (event, error) {
+	var e event
+	if err := json.Unmarshal([]byte(aws.StringValue(message.Body)), &e); err != nil {
+		return e, fmt.Errorf("could not decode sqs message: %v", err)
+	}
+	return e, nil
+}
+
+// receiveCount returns how many times the message has been delivered, it is 1
+// when SQS doesn't report it.
+func receiveCount(msg sqs.Message) int {
+	n, err := strconv.Atoi(msg.Attributes[string(sqs.MessageSystemAttributeNameApproximateReceiveCount)])
+	if err != nil || n < 1 {
+		return 1
+	}
+	return n
+}
+
+// handleEvent returns nil for events the worker has nothing to do with so
+// that they are removed from the queue instead of being redelivered forever.
+func (w *Worker) handleEvent(logger *logging.Logger, e event, attempt int) error {
+	switch e.EventType {
+	case userCreatedEvent:
+		var payload userCreatedPayload
+		if err := decodeEventPayload(e, &payload); err != nil {
+			return err
+		}
+		logger = logger.With(logging.Fields{"user_id": payload.UserID, "attempt": attempt})
+		logger.Debugf("provisioning kong consumer")
+		err := w.setupKongConsumer(payload.UserID)
+		if err != nil && attempt >= maxProvisioningAttempts {
+			logger.Errorf("giving up provisioning kong consumer: %v", err)
+			return w.store.setProvisioningFailed(payload.UserID)
+		}
 		return err
+	case userLockedOutEvent:
+		var payload userLockedOutPayload
+		if err := decodeEventPayload(e, &payload); err != nil {
+			return err
+		}
+		logger.With(logging.Fields{
+			"key_type":     payload.KeyType,
+			"key":          payload.Key,
+			"locked_until": payload.LockedUntil,
+		}).Warnf("login locked out")
+		return nil
+	case organizationInvitationCreatedEvent, listInvitationCreatedEvent, listSharedEvent:
+		// the invitee was emailed by the users service, nothing left to do
+		return nil
+	default:
+		logger.Warnf("ignoring unknown event type")
+		return nil
+	}
+}
+
+func decodeEventPayload(e event, payload interface{}) error {
+	if err := json.Unmarshal(e.Payload, payload); err != nil {
+		return fmt.Errorf("could not decode %s payload: %v", e.EventType, err)
+	}
+	return nil
+}
+
+// setupKongConsumer skips users that are gone or no longer pending so that a
+// redelivered event doesn't create a second consumer.
+func (w *Worker) setupKongConsumer(userID string) error {
+	u, err := w.store.getUser(userID)
+	if err == sql.ErrNoRows || (err == nil && u.ProvisioningStatus != userStatusPending) {
+		return nil
 	}
-	if err := w.kong.createJWTCredentials(consumerID); err != nil {
+	if err != nil {
 		return err
 	}
+	return provisionConsumer(w.store, w.kong, userID)
+}
+
+// provisionConsumer can be attempted more than once for the same user, even
+// concurrently. Attempts are serialized with a lock on the user so that each
+// one sees what the previous created, and Kong enforces unique custom ids.
+func provisionConsumer(s Store, kong KongClient, userID string) error {
+	return s.withUserLock(userID, func() error {
+		consumer, err := kong.findConsumerByCustomID(userID)
+		if err != nil {
+			return err
+		}
+
+		var consumerID string
+		if consumer != nil {
+			consumerID = consumer.ID
+		} else if consumerID, err = kong.createConsumer(userID); err != nil {
+			// another run may have created it in the meantime
+			if consumer, _ := kong.findConsumerByCustomID(userID); consumer != nil {
+				consumerID = consumer.ID
+			} else {
+				return err
+			}
+		}
+
+		credentials, err := kong.getJWTCredentials(consumerID)
+		if err != nil {
+			return err
+		}
+		if len(credentials) == 0 {
+			if err := kong.createJWTCredentials(consumerID); err != nil {
+				return err
+			}
+		}
+
+		u, err := s.getUser(userID)
+		if err != nil {
+			return err
+		}
+		if err := syncACLGroups(kong, consumerID, u.Roles); err != nil {
+			return err
+		}
 
-	return w.store.setConsumerID(userID, consumerID)
+		return s.setConsumerID(userID, consumerID)
+	})
 }
@@ -0,0 +1,171 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/diorman/todospoc/logging"
+)
+
+func TestWorkerLifecycle(t *testing.T) {
+	w := NewWorker(&testSQSClient{}, &testStore{}, &testKongClient{}, "user-events")
+
+	if err := w.CheckHeartbeat(context.Background()); err == nil {
+		t.Errorf("expected heartbeat check to fail before start")
+	}
+
+	go w.Start()
+	deadline := time.Now().Add(time.Second)
+	for w.CheckHeartbeat(context.Background()) != nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if err := w.CheckHeartbeat(context.Background()); err != nil {
+		t.Errorf("unexpected heartbeat error: %v", err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		w.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Errorf("worker did not stop")
+	}
+}
+
+type panickingKongClient struct {
+	testKongClient
+}
+
+func (kong *panickingKongClient) createConsumer(userID string) (string, error) {
+	panic("kong client bug")
+}
+
+func TestWorkerRecoversFromPanics(t *testing.T) {
+	var (
+		body          = `{"event_type":"user_created","payload":{"user_id":"123"}}`
+		receiptHandle = "receipt"
+		sqsClient     = &testSQSClient{}
+		store         = &testStore{}
+		w             = NewWorker(sqsClient, store, &panickingKongClient{}, "user-events")
+	)
+	store.getUserReturn.user = testPendingUser
+
+	w.processMessage(logging.New(ioutil.Discard, logging.ErrorLevel), sqs.Message{Body: &body, ReceiptHandle: &receiptHandle})
+
+	if sqsClient.deletedMessages != 0 {
+		t.Errorf("expected message to be left for redelivery")
+	}
+}
+
+type failingKongClient struct {
+	testKongClient
+}
+
+func (kong *failingKongClient) createConsumer(userID string) (string, error) {
+	return "", errors.New("kong is down")
+}
+
+func TestWorkerProvisioningAttempts(t *testing.T) {
+	tests := map[string]struct {
+		user            user
+		receiveCount    string
+		deletedMessages int
+		failedUsers     int
+	}{
+		"leaves the message for redelivery when attempts are left": {
+			user:            testPendingUser,
+			receiveCount:    "1",
+			deletedMessages: 0,
+			failedUsers:     0,
+		},
+		"marks the user as failed after the last attempt": {
+			user:            testPendingUser,
+			receiveCount:    "5",
+			deletedMessages: 1,
+			failedUsers:     1,
+		},
+		"skips users that are already provisioned": {
+			user:            testUser,
+			receiveCount:    "1",
+			deletedMessages: 1,
+			failedUsers:     0,
+		},
+	}
+
+	for td, tt := range tests {
+		var (
+			body          = `{"event_type":"user_created","payload":{"user_id":"` + tt.user.ID + `"}}`
+			receiptHandle = "receipt"
+			sqsClient     = &testSQSClient{}
+			store         = &testStore{}
+			w             = NewWorker(sqsClient, store, &failingKongClient{}, "user-events")
+			msg           = sqs.Message{
+				Body:          &body,
+				ReceiptHandle: &receiptHandle,
+				Attributes:    map[string]string{"ApproximateReceiveCount": tt.receiveCount},
+			}
+		)
+		store.getUserReturn.user = tt.user
+
+		w.processMessage(logging.New(ioutil.Discard, logging.ErrorLevel), msg)
+
+		if sqsClient.deletedMessages != tt.deletedMessages {
+			t.Errorf("%v: wrong number of deleted messages: expected %v, got %v", td, tt.deletedMessages, sqsClient.deletedMessages)
+		}
+		if len(store.setProvisioningFailedCalls) != tt.failedUsers {
+			t.Errorf("%v: wrong number of failed users: expected %v, got %v", td, tt.failedUsers, len(store.setProvisioningFailedCalls))
+		}
+	}
+}
+
+func TestProvisionConsumerIsIdempotent(t *testing.T) {
+	tests := map[string]struct {
+		existingConsumer      *KongConsumer
+		existingCredentials   []JWTCredentials
+		createdConsumers      int
+		createdJWTCredentials int
+	}{
+		"creates consumer and credentials when none exist": {
+			createdConsumers:      1,
+			createdJWTCredentials: 1,
+		},
+		"reuses existing consumer and creates missing credentials": {
+			existingConsumer:      &KongConsumer{ID: "c1", CustomID: "u1"},
+			createdConsumers:      0,
+			createdJWTCredentials: 1,
+		},
+		"reuses existing consumer and credentials": {
+			existingConsumer:      &KongConsumer{ID: "c1", CustomID: "u1"},
+			existingCredentials:   []JWTCredentials{testJWTCredentials},
+			createdConsumers:      0,
+			createdJWTCredentials: 0,
+		},
+	}
+
+	for td, tt := range tests {
+		k := testKongClient{}
+		k.findConsumerByCustomIDReturn.consumer = tt.existingConsumer
+		k.getJWTCredentialsReturn.jwtCredentials = tt.existingCredentials
+
+		s := testStore{}
+		if err := provisionConsumer(&s, &k, "u1"); err != nil {
+			t.Errorf("%v: unexpected error: %v", td, err)
+		}
+		if len(s.userLocks) != 1 || s.userLocks[0] != "u1" {
+			t.Errorf("%v: expected provisioning to hold the user lock, got %v", td, s.userLocks)
+		}
+		if k.createdConsumers != tt.createdConsumers {
+			t.Errorf("%v: wrong number of created consumers: expected %v, got %v", td, tt.createdConsumers, k.createdConsumers)
+		}
+		if k.createdJWTCredentials != tt.createdJWTCredentials {
+			t.Errorf("%v: wrong number of created jwt credentials: expected %v, got %v", td, tt.createdJWTCredentials, k.createdJWTCredentials)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 
@@ -32,6 +33,7 @@ type SQSClient interface {
 	CreateQueue(queueName string) (*sqs.CreateQueueOutput, error)
 	ReceiveMessage(queueName string, maxMessages, waitTime int64) ([]sqs.Message, error)
 	DeleteMessage(queueName string, receiptHandle string) error
+	GetQueueAttributes(queueName string, attributeNames ...sqs.QueueAttributeName) (map[string]string, error)
 }
 
 type sqsClientImpl struct {
@@ -76,6 +78,7 @@ func (client *sqsClientImpl) ReceiveMessage(queueName string, maxMessages, waitT
 		QueueUrl:            &queueURL,
 		MaxNumberOfMessages: &maxMessages,
 		WaitTimeSeconds:     &waitTime,
+		AttributeNames:      []sqs.QueueAttributeName{sqs.QueueAttributeName(sqs.MessageSystemAttributeNameApproximateReceiveCount)},
 	})
 	res, err := req.Send()
 	if err != nil {
@@ -97,3 +100,26 @@ func (client *sqsClientImpl) DeleteMessage(queueName string, receiptHandle strin
 	}
 	return nil
 }
+
+func (client *sqsClientImpl) GetQueueAttributes(queueName string, attributeNames ...sqs.QueueAttributeName) (map[string]string, error) {
+	var (
+		queueURL = QueueURL(queueName)
+	)
+	req := client.SQS.GetQueueAttributesRequest(&sqs.GetQueueAttributesInput{
+		QueueUrl:       &queueURL,
+		AttributeNames: attributeNames,
+	})
+	res, err := req.Send()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get attributes of queue %s: %v", queueName, err)
+	}
+	return res.Attributes, nil
+}
+
+// QueueCheck verifies that queueName exists and can be reached.
+func QueueCheck(client SQSClient, queueName string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		_, err := client.GetQueueAttributes(queueName, sqs.QueueAttributeNameApproximateNumberOfMessages)
+		return err
+	}
+}
@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/diorman/todospoc/logging"
+)
+
+const (
+	problemContentType = "application/problem+json"
+	MaxRequestBodySize = 1 << 20
+)
+
+// Problem is an RFC 7807 problem details object extended with a machine
+// readable code, per-field errors and the id of the request that failed.
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      string       `json:"code"`
+	Errors    []FieldError `json:"errors,omitempty"`
+	RequestID string       `json:"request_id,omitempty"`
+}
+
+func NewProblem(status int, code, detail string) *Problem {
+	return &Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+func (p *Problem) Error() string {
+	if p.Detail == "" {
+		return fmt.Sprintf("%d %s", p.Status, p.Code)
+	}
+	return fmt.Sprintf("%d %s: %s", p.Status, p.Code, p.Detail)
+}
+
+// ProblemFromError maps err to the problem sent to clients. Errors that are
+// not problems or validation errors are reported as an opaque 500.
+func ProblemFromError(err error) *Problem {
+	switch e := err.(type) {
+	case *Problem:
+		return e
+	case ValidationError:
+		p := NewProblem(http.StatusBadRequest, "validation_failed", "request has invalid fields")
+		p.Errors = e
+		return p
+	default:
+		return NewProblem(http.StatusInternalServerError, "internal_error", "")
+	}
+}
+
+func WriteProblem(w http.ResponseWriter, r *http.Request, err error) {
+	p := *ProblemFromError(err)
+	p.Instance = r.URL.Path
+	p.RequestID = logging.RequestID(r.Context())
+
+	jsonData, err := json.Marshal(p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", problemContentType)
+	w.WriteHeader(p.Status)
+	w.Write(jsonData)
+}
+
+// DecodeJSON decodes the request body into v, rejecting bodies that are not
+// JSON, larger than MaxRequestBodySize, contain unknown fields or trailing
+// data. The returned error is always a *Problem.
+func DecodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || mediaType != "application/json" {
+			return NewProblem(http.StatusUnsupportedMediaType, "unsupported_media_type", "request body must be application/json")
+		}
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxRequestBodySize))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(v); err != nil {
+		return decodeErrorProblem(err)
+	}
+	if err := decoder.Decode(&struct{}{}); err != io.EOF {
+		return NewProblem(http.StatusBadRequest, "malformed_json", "request body must contain a single JSON object")
+	}
+	return nil
+}
+
+func decodeErrorProblem(err error) *Problem {
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		return NewProblem(http.StatusBadRequest, "malformed_json", fmt.Sprintf("malformed JSON at offset %d", e.Offset))
+	case *json.UnmarshalTypeError:
+		p := NewProblem(http.StatusBadRequest, "validation_failed", "request has invalid fields")
+		p.Errors = []FieldError{{Field: e.Field, Message: fmt.Sprintf("must be of type %s", e.Type)}}
+		return p
+	}
+
+	switch message := err.Error(); {
+	case err == io.EOF:
+		return NewProblem(http.StatusBadRequest, "malformed_json", "request body can't be empty")
+	case err == io.ErrUnexpectedEOF:
+		return NewProblem(http.StatusBadRequest, "malformed_json", "request body contains malformed JSON")
+	case strings.HasPrefix(message, "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(message, "json: unknown field "), `"`)
+		p := NewProblem(http.StatusBadRequest, "validation_failed", "request has invalid fields")
+		p.Errors = []FieldError{{Field: field, Message: "unknown field"}}
+		return p
+	case message == "http: request body too large":
+		return NewProblem(http.StatusRequestEntityTooLarge, "body_too_large", fmt.Sprintf("request body must not exceed %d bytes", MaxRequestBodySize))
+	default:
+		return NewProblem(http.StatusBadRequest, "malformed_json", message)
+	}
+}
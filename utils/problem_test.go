@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDecodeJSON(t *testing.T) {
+	tests := map[string]struct {
+		requestBody string
+		contentType string
+		status      int
+		code        string
+	}{
+		"decodes valid body": {
+			requestBody: `{"name": "todo"}`,
+			contentType: "application/json; charset=utf-8",
+		},
+		"rejects non JSON content type": {
+			requestBody: `{"name": "todo"}`,
+			contentType: "text/plain",
+			status:      http.StatusUnsupportedMediaType,
+			code:        "unsupported_media_type",
+		},
+		"rejects empty body": {
+			status: http.StatusBadRequest,
+			code:   "malformed_json",
+		},
+		"rejects syntax errors": {
+			requestBody: `{"name": todo}`,
+			status:      http.StatusBadRequest,
+			code:        "malformed_json",
+		},
+		"rejects trailing data": {
+			requestBody: `{"name": "todo"}{}`,
+			status:      http.StatusBadRequest,
+			code:        "malformed_json",
+		},
+		"rejects wrong field types": {
+			requestBody: `{"name": 1}`,
+			status:      http.StatusBadRequest,
+			code:        "validation_failed",
+		},
+		"rejects unknown fields": {
+			requestBody: `{"name": "todo", "done": true}`,
+			status:      http.StatusBadRequest,
+			code:        "validation_failed",
+		},
+		"rejects oversized body": {
+			requestBody: `{"name": "` + strings.Repeat("a", MaxRequestBodySize) + `"}`,
+			status:      http.StatusRequestEntityTooLarge,
+			code:        "body_too_large",
+		},
+	}
+
+	for td, tt := range tests {
+		r, _ := http.NewRequest("POST", "/", bytes.NewBufferString(tt.requestBody))
+		if tt.contentType != "" {
+			r.Header.Set("Content-Type", tt.contentType)
+		}
+		v := struct {
+			Name string `json:"name"`
+		}{}
+
+		err := DecodeJSON(httptest.NewRecorder(), r, &v)
+
+		if tt.status == 0 {
+			if err != nil {
+				t.Errorf("%v: unexpected error: %v", td, err)
+			}
+			continue
+		}
+		p, ok := err.(*Problem)
+		if !ok {
+			t.Errorf("%v: expected problem, got %v", td, err)
+			continue
+		}
+		if p.Status != tt.status || p.Code != tt.code {
+			t.Errorf("%v: unexpected problem: expected %v %v, got %v %v", td, tt.status, tt.code, p.Status, p.Code)
+		}
+	}
+}
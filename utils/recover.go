@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/diorman/todospoc/logging"
+)
+
+// PanicHandler logs a recovered panic with its stack and answers with a
+// problem+json 500. It matches the signature of httprouter.Router.PanicHandler.
+func PanicHandler(w http.ResponseWriter, r *http.Request, rcv interface{}) {
+	logging.FromContext(r.Context()).With(logging.Fields{
+		"panic": fmt.Sprint(rcv),
+		"stack": string(debug.Stack()),
+	}).Errorf("recovered from panic serving %s %s", r.Method, r.URL.Path)
+	WriteProblem(w, r, fmt.Errorf("panic: %v", rcv))
+}
+
+// RecoverMiddleware recovers panics raised outside of the router, e.g. in
+// other middlewares, and handles them with PanicHandler.
+func RecoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if rcv := recover(); rcv != nil {
+				if rcv == http.ErrAbortHandler {
+					panic(rcv)
+				}
+				PanicHandler(w, r, rcv)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,27 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRecoverMiddleware(t *testing.T) {
+	h := RecoverMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+	r, _ := http.NewRequest("GET", "/things", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("handler returned wrong status code: expected %v, got %v", http.StatusInternalServerError, w.Code)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != problemContentType {
+		t.Errorf("handler returned wrong content type: %v", contentType)
+	}
+	if strings.Contains(w.Body.String(), "boom") {
+		t.Errorf("handler leaked panic value: %v", w.Body.String())
+	}
+}
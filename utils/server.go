@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func NewHTTPServer(addr string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      15 * time.Second,
+		IdleTimeout:       60 * time.Second,
+		MaxHeaderBytes:    1 << 16,
+	}
+}
+
+// RunServer serves srv until it fails or the process receives SIGINT or
+// SIGTERM. On a signal beforeShutdown is called, which is expected to take the
+// instance out of rotation, and then in-flight requests are given up to
+// shutdownTimeout to complete.
+func RunServer(srv *http.Server, shutdownTimeout time.Duration, beforeShutdown func()) error {
+	var (
+		errc    = make(chan error, 1)
+		signals = make(chan os.Signal, 1)
+	)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errc:
+		return fmt.Errorf("http server failed: %v", err)
+	case <-signals:
+	}
+
+	beforeShutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		return fmt.Errorf("http server shutdown failed: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type ValidationError []FieldError
+
+func (e ValidationError) Error() string {
+	messages := make([]string, len(e))
+	for i, fe := range e {
+		messages[i] = fmt.Sprintf("%s: %s", fe.Field, fe.Message)
+	}
+	return fmt.Sprintf("validation failed: %s", strings.Join(messages, "; "))
+}
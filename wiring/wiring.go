@@ -0,0 +1,134 @@
+package wiring
+
+import (
+	"database/sql"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/diorman/todospoc"
+	"github.com/diorman/todospoc/health"
+	"github.com/diorman/todospoc/logging"
+	"github.com/diorman/todospoc/mail"
+	"github.com/diorman/todospoc/metrics"
+	"github.com/diorman/todospoc/oidc"
+	"github.com/diorman/todospoc/users"
+	"github.com/diorman/todospoc/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+
+	_ "github.com/lib/pq"
+)
+
+const (
+	readinessTimeout = 2 * time.Second
+	readinessTTL     = 5 * time.Second
+
+	// DrainDelay gives load balancers time to observe the failing readiness
+	// check before the server stops accepting connections.
+	DrainDelay      = 5 * time.Second
+	ShutdownTimeout = 20 * time.Second
+)
+
+// Users holds the dependencies shared by the users API and the users worker.
+type Users struct {
+	DB       *sql.DB
+	SQS      utils.SQSClient
+	Store    users.Store
+	Kong     users.KongClient
+	Throttle users.LoginThrottle
+	Mail     mail.Sender
+	IDP      users.IdentityProvider
+}
+
+func NewLogger(service string) (*logging.Logger, error) {
+	level, err := logging.ParseLevel(todospoc.Config.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	logger := logging.New(os.Stderr, level).With(logging.Fields{"service": service})
+	logging.SetDefault(logger)
+	return logger, nil
+}
+
+func NewUsers() (*Users, error) {
+	db, err := utils.CreateSQLDatabaseConnection(todospoc.Config.MainSQLDBSource)
+	if err != nil {
+		return nil, err
+	}
+	sqs, err := utils.NewSQSClient()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	u := &Users{
+		DB:       db,
+		SQS:      sqs,
+		Store:    users.NewStore(db),
+		Kong:     users.NewKongClient(todospoc.Config.KongAdminAddress),
+		Throttle: users.NewLoginThrottle(db),
+		Mail:     newMailSender(),
+		IDP:      newIdentityProvider(),
+	}
+	prometheus.MustRegister(
+		metrics.NewDBStatsCollector("main", db),
+		users.NewProvisioningBacklogCollector(u.Store),
+	)
+	return u, nil
+}
+
+// newMailSender logs emails instead of sending them when no SMTP server is
+// configured.
+func newMailSender() mail.Sender {
+	if todospoc.Config.SMTPAddress == "" {
+		return mail.NewLogSender(logging.Default())
+	}
+	return mail.NewSMTPSender(todospoc.Config.SMTPAddress, todospoc.Config.EmailFrom, todospoc.Config.SMTPUsername, todospoc.Config.SMTPPassword)
+}
+
+// newIdentityProvider returns nil, which disables OpenID Connect sign in, when
+// no issuer is configured.
+func newIdentityProvider() users.IdentityProvider {
+	if todospoc.Config.OIDCIssuer == "" {
+		return nil
+	}
+	return oidc.NewProvider(todospoc.Config.OIDCIssuer, todospoc.Config.OIDCClientID, todospoc.Config.OIDCClientSecret, todospoc.Config.OIDCRedirectURL)
+}
+
+func (u *Users) NewWorker() *users.Worker {
+	return users.NewWorker(u.SQS, u.Store, u.Kong, todospoc.Config.UserEventsQueueName)
+}
+
+func (u *Users) NewReconciler(dryRun bool) *users.Reconciler {
+	return users.NewReconciler(u.Store, u.Kong, dryRun)
+}
+
+// NewChecker returns a readiness checker for the dependencies of u. The SQS
+// queue and Kong are checked by both binaries since both depend on them.
+func (u *Users) NewChecker() *health.Checker {
+	checker := health.NewChecker(readinessTimeout, readinessTTL)
+	checker.Add("database", u.DB.PingContext)
+	checker.Add("kong", health.HTTPCheck(todospoc.Config.KongAdminAddress+"/status"))
+	checker.Add("sqs", utils.QueueCheck(u.SQS, todospoc.Config.UserEventsQueueName))
+	return checker
+}
+
+func (u *Users) Close() error {
+	return u.DB.Close()
+}
+
+// NewHTTPServer serves h on addr wrapped with the middlewares every service
+// shares: request ids and access logs, then panic recovery.
+func NewHTTPServer(addr string, h http.Handler) *http.Server {
+	return utils.NewHTTPServer(addr, logging.Middleware(utils.RecoverMiddleware(h)))
+}
+
+// AddOperationalRoutes exposes the liveness, readiness and metrics endpoints
+// and recovers panics raised by any of the router handlers.
+func AddOperationalRoutes(router *httprouter.Router, checker *health.Checker) {
+	router.PanicHandler = utils.PanicHandler
+	router.Handler("GET", "/livez", health.LivenessHandler())
+	router.Handler("GET", "/readyz", checker.ReadinessHandler())
+	router.Handler("GET", "/metrics", metrics.Handler())
+}